@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// activeJobWrappers are the Sidekiq classes ActiveJob's Sidekiq adapter
+// enqueues under: the Rails adapter's and, since Sidekiq 7.3, Sidekiq's own.
+var activeJobWrappers = map[string]bool{
+	"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper": true,
+	"Sidekiq::ActiveJob::Wrapper":                          true,
+}
+
+// Reserved keys ActiveJob::Arguments uses to serialize values JSON cannot
+// represent directly.
+const (
+	ajGlobalIDKey        = "_aj_globalid"
+	ajSymbolKeysKey      = "_aj_symbol_keys"
+	ajRuby2KeywordsKey   = "_aj_ruby2_keywords"
+	ajIndifferentKey     = "_aj_hash_with_indifferent_access"
+	ajObjectSerializer   = "_aj_serialized"
+	ajSerializedValueKey = "value"
+)
+
+// activeJobData is the serialized ActiveJob that the wrapper carries as its
+// only argument.
+type activeJobData struct {
+	JobClass  string            `json:"job_class"`
+	JobID     string            `json:"job_id"`
+	Arguments []json.RawMessage `json:"arguments"`
+}
+
+func isActiveJob(job *sidekiqJob) bool {
+	return activeJobWrappers[job.Class]
+}
+
+// displayClass is the class to show for a job: the wrapped ActiveJob class
+// for ActiveJob payloads, as in Sidekiq's JobRecord#display_class.
+func (j *sidekiqJob) displayClass() string {
+	if isActiveJob(j) {
+		var wrapped string
+		if err := j.get("wrapped", &wrapped); err == nil && wrapped != "" {
+			return wrapped
+		}
+		if data, err := activeJobPayload(j); err == nil && data.JobClass != "" {
+			return data.JobClass
+		}
+	}
+	return j.Class
+}
+
+// unwrapActiveJob returns the job handlers should see: for an ActiveJob
+// payload, a copy whose class is the ActiveJob job_class and whose args are
+// the deserialized arguments; any other job is returned as is. The original
+// payload is what goes back to Redis on failure, so Ruby can still run it.
+func unwrapActiveJob(job *sidekiqJob) (*sidekiqJob, error) {
+	if !isActiveJob(job) {
+		return job, nil
+	}
+	data, err := activeJobPayload(job)
+	if err != nil {
+		return nil, err
+	}
+	if data.JobClass == "" {
+		return nil, fmt.Errorf("activejob payload has no job_class")
+	}
+	args := make([]json.RawMessage, 0, len(data.Arguments))
+	for i, raw := range data.Arguments {
+		arg, err := deserializeActiveJobArgument(raw)
+		if err != nil {
+			return nil, fmt.Errorf("activejob argument %d: %w", i, err)
+		}
+		args = append(args, arg)
+	}
+	inner := job.clone()
+	inner.Class = data.JobClass
+	inner.Args = args
+	if data.JobID != "" {
+		inner.set("active_job_id", data.JobID)
+	}
+	return inner, nil
+}
+
+func activeJobPayload(job *sidekiqJob) (activeJobData, error) {
+	var data activeJobData
+	if len(job.Args) != 1 {
+		return data, fmt.Errorf("activejob payload has %d args, want 1", len(job.Args))
+	}
+	if err := json.Unmarshal(job.Args[0], &data); err != nil {
+		return data, fmt.Errorf("activejob payload: %w", err)
+	}
+	return data, nil
+}
+
+// deserializeActiveJobArgument undoes ActiveJob::Arguments.serialize as far
+// as plain JSON allows: GlobalID references become their "gid://" URI,
+// symbol-keyed and indifferent hashes become plain objects, and custom
+// serializers (symbols, times, durations, decimals...) become their value.
+func deserializeActiveJobArgument(raw json.RawMessage) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(deserializeActiveJobValue(v))
+}
+
+func deserializeActiveJobValue(v any) any {
+	switch v := v.(type) {
+	case []any:
+		for i := range v {
+			v[i] = deserializeActiveJobValue(v[i])
+		}
+		return v
+	case map[string]any:
+		if gid, ok := v[ajGlobalIDKey]; ok && len(v) == 1 {
+			return gid
+		}
+		if _, ok := v[ajObjectSerializer]; ok {
+			if value, ok := v[ajSerializedValueKey]; ok {
+				return deserializeActiveJobValue(value)
+			}
+		}
+		delete(v, ajSymbolKeysKey)
+		delete(v, ajRuby2KeywordsKey)
+		delete(v, ajIndifferentKey)
+		for k := range v {
+			v[k] = deserializeActiveJobValue(v[k])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// parseGlobalID splits a "gid://app/Model/id" URI into its model name and id.
+func parseGlobalID(s string) (model, id string, ok bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "gid" || u.Host == "" {
+		return "", "", false
+	}
+	model, id, ok = strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if !ok || model == "" || id == "" {
+		return "", "", false
+	}
+	return model, id, true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+const activeJobPayloadJSON = `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","wrapped":"ReportJob","queue":"default","args":[{"job_class":"ReportJob","job_id":"b7c1","queue_name":"default","arguments":[{"_aj_globalid":"gid://benchmark-ui/TestRun/42"},{"format":"csv","_aj_symbol_keys":["format"]},{"_aj_serialized":"ActiveJob::Serializers::SymbolSerializer","value":"fast"},[1,{"deep":{"_aj_globalid":"gid://benchmark-ui/Sample/7"}}]],"executions":0}],"jid":"abc","retry":true}`
+
+func TestUnwrapActiveJob(t *testing.T) {
+	job := decodeJob(t, activeJobPayloadJSON)
+	run, err := unwrapActiveJob(job)
+	if err != nil {
+		t.Fatalf("unwrap error: %v", err)
+	}
+	if run.Class != "ReportJob" {
+		t.Fatalf("expected inner class, got %s", run.Class)
+	}
+	want := []string{
+		`"gid://benchmark-ui/TestRun/42"`,
+		`{"format":"csv"}`,
+		`"fast"`,
+		`[1,{"deep":"gid://benchmark-ui/Sample/7"}]`,
+	}
+	if len(run.Args) != len(want) {
+		t.Fatalf("expected %d args, got %s", len(want), formatArgs(run.Args))
+	}
+	for i, w := range want {
+		if string(run.Args[i]) != w {
+			t.Fatalf("arg %d: expected %s, got %s", i, w, run.Args[i])
+		}
+	}
+	var ajID string
+	_ = run.get("active_job_id", &ajID)
+	if ajID != "b7c1" {
+		t.Fatalf("expected active_job_id, got %q", ajID)
+	}
+	if job.Class != "ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper" || len(job.Args) != 1 {
+		t.Fatalf("original job must be left untouched: %s %s", job.Class, formatArgs(job.Args))
+	}
+	if job.displayClass() != "ReportJob" {
+		t.Fatalf("unexpected display class: %s", job.displayClass())
+	}
+}
+
+func TestUnwrapActiveJobLeavesSidekiqJobs(t *testing.T) {
+	job := decodeJob(t, `{"class":"RubyWorker","args":[1]}`)
+	run, err := unwrapActiveJob(job)
+	if err != nil || run != job {
+		t.Fatalf("expected the job itself, got %v %v", run, err)
+	}
+}
+
+func TestUnwrapActiveJobRejectsBrokenPayloads(t *testing.T) {
+	for _, payload := range []string{
+		`{"class":"Sidekiq::ActiveJob::Wrapper","args":[]}`,
+		`{"class":"Sidekiq::ActiveJob::Wrapper","args":[{"arguments":[]}]}`,
+		`{"class":"Sidekiq::ActiveJob::Wrapper","args":["ReportJob"]}`,
+	} {
+		if _, err := unwrapActiveJob(decodeJob(t, payload)); err == nil {
+			t.Fatalf("expected error for %s", payload)
+		}
+	}
+}
+
+func TestParseGlobalID(t *testing.T) {
+	model, id, ok := parseGlobalID("gid://benchmark-ui/TestRun/42")
+	if !ok || model != "TestRun" || id != "42" {
+		t.Fatalf("unexpected parse: %s %s %t", model, id, ok)
+	}
+	for _, s := range []string{"42", "gid://app/TestRun", "http://app/TestRun/1"} {
+		if _, _, ok := parseGlobalID(s); ok {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestTestRunJobAcceptsGlobalID(t *testing.T) {
+	job := &sidekiqJob{Class: "ReportJob", Args: []json.RawMessage{json.RawMessage(`"gid://app/Sample/1"`)}}
+	if err := testRunJob(nil, false)(context.Background(), job); err == nil {
+		t.Fatalf("expected a non-TestRun GlobalID to be rejected")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// enqueueOptions are the Sidekiq client options this worker supports when
+// pushing jobs.
+type enqueueOptions struct {
+	Queue string
+	// Retry is encoded as-is into the payload: true, false or a limit.
+	Retry any
+	// Lock makes the job unique on class and args; until_executing and
+	// until_executed locks are taken at enqueue. LockTTL defaults to an hour.
+	Lock    uniqueStrategy
+	LockTTL time.Duration
+}
+
+// newJob builds a payload the way Sidekiq::Client#normalize_item does:
+// class, args, retry, queue, a fresh jid and created_at.
+func newJob(class string, args []any, opts enqueueOptions, now time.Time) (*sidekiqJob, error) {
+	if class == "" {
+		return nil, errors.New("job class is required")
+	}
+	queue := opts.Queue
+	if queue == "" {
+		queue = "default"
+	}
+	retry := opts.Retry
+	if retry == nil {
+		retry = true
+	}
+	retryRaw, err := json.Marshal(retry)
+	if err != nil {
+		return nil, fmt.Errorf("retry: %w", err)
+	}
+	raw := make([]json.RawMessage, 0, len(args))
+	for i, a := range args {
+		b, err := json.Marshal(a)
+		if err != nil {
+			return nil, fmt.Errorf("arg %d: %w", i, err)
+		}
+		raw = append(raw, b)
+	}
+
+	job := &sidekiqJob{
+		Class:     class,
+		Args:      raw,
+		Queue:     queue,
+		Retry:     retryRaw,
+		JID:       newJID(),
+		CreatedAt: epochSeconds(now),
+	}
+	if opts.Lock != "" {
+		job.set("lock", opts.Lock)
+		if opts.LockTTL > 0 {
+			job.set("lock_ttl", opts.LockTTL.Seconds())
+		}
+	}
+	return job, nil
+}
+
+// enqueue pushes the job onto queue:<name> (registering the queue in the
+// queues set, as Sidekiq does) or, when at is in the future, adds it to the
+// schedule set for the poller to promote. It returns the job's jid, or an
+// errDuplicateJob error if an identical job holds its uniqueness lock.
+func enqueue(rw *bufio.ReadWriter, job *sidekiqJob, at time.Time, now time.Time) (string, error) {
+	if strategy, ttl := (uniqueConfig{}).lockFor(job); strategy == uniqueUntilExecuting || strategy == uniqueUntilExecuted {
+		key := uniqueKey(job)
+		ok, err := acquireLock(rw, key, job.JID, ttl)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("%w: %s lock %s is held", errDuplicateJob, strategy, key)
+		}
+	}
+
+	if !at.IsZero() && at.After(now) {
+		payload, err := json.Marshal(job)
+		if err != nil {
+			return "", err
+		}
+		if err := writeCommand(rw, "ZADD", scheduleSetKey, formatScore(at), string(payload)); err != nil {
+			return "", err
+		}
+		_, err = readInteger(rw)
+		return job.JID, err
+	}
+
+	job.EnqueuedAt = epochSeconds(now)
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	cmds := [][]string{
+		{"SADD", "queues", job.Queue},
+		{"LPUSH", "queue:" + job.Queue, string(payload)},
+	}
+	if _, err := execMulti(rw, cmds); err != nil {
+		return "", err
+	}
+	return job.JID, nil
+}
+
+// newJID returns 12 random bytes as hex, the format of Sidekiq job ids.
+func newJID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseCLIArg turns a command line argument into a job argument: valid JSON
+// (numbers, quoted strings, objects) is used as-is, anything else is a string.
+func parseCLIArg(s string) any {
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	return s
+}
+
+// parseRetryOption accepts true, false or a retry limit.
+func parseRetryOption(s string) (any, error) {
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid retry option %q (want true, false or a count)", s)
+	}
+	return n, nil
+}
+
+// runEnqueueCommand implements `go_worker enqueue [flags] <Class> [args...]`.
+func runEnqueueCommand(argv []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	queue := fs.String("queue", "default", "Queue to push the job onto")
+	retry := fs.String("retry", "true", "Retry option: true, false or a retry count")
+	in := fs.Duration("in", 0, "Schedule the job to run after this delay (like perform_in)")
+	at := fs.String("at", "", "Schedule the job to run at this RFC 3339 time (like perform_at)")
+	lock := fs.String("lock", "", "Unique lock: until_executing, until_executed or while_executing")
+	lockTTL := fs.Duration("lock-ttl", 0, "How long the unique lock may be held (default 1h)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: go_worker enqueue [flags] <Class> [args...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return errors.New("missing job class")
+	}
+
+	retryOpt, err := parseRetryOption(*retry)
+	if err != nil {
+		return err
+	}
+	var strategy uniqueStrategy
+	if *lock != "" {
+		if strategy, err = parseUniqueStrategy(*lock); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	var runAt time.Time
+	switch {
+	case *at != "" && *in != 0:
+		return errors.New("use only one of --in and --at")
+	case *at != "":
+		runAt, err = time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("invalid --at: %w", err)
+		}
+	case *in != 0:
+		runAt = now.Add(*in)
+	}
+
+	args := make([]any, 0, fs.NArg()-1)
+	for _, a := range fs.Args()[1:] {
+		args = append(args, parseCLIArg(a))
+	}
+	job, err := newJob(fs.Arg(0), args, enqueueOptions{Queue: *queue, Retry: retryOpt, Lock: strategy, LockTTL: *lockTTL}, now)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := redisConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	conn, rw, err := dialRedis(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	jid, err := enqueue(rw, job, runAt, now)
+	if err != nil {
+		return fmt.Errorf("enqueue failed: %w", err)
+	}
+	if runAt.After(now) {
+		fmt.Fprintf(os.Stdout, "scheduled jid=%s class=%s queue=%s at=%s\n", jid, job.Class, job.Queue, runAt.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(os.Stdout, "enqueued jid=%s class=%s queue=%s\n", jid, job.Class, job.Queue)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewJob(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	job, err := newJob("RubyWorker", []any{42, "x"}, enqueueOptions{Queue: "go"}, now)
+	if err != nil {
+		t.Fatalf("newJob error: %v", err)
+	}
+	if len(job.JID) != 24 {
+		t.Fatalf("expected 24 char jid, got %q", job.JID)
+	}
+	if job.CreatedAt != 1700000000 {
+		t.Fatalf("unexpected created_at: %v", job.CreatedAt)
+	}
+	if limit, enabled := maxRetries(job); limit != defaultMaxRetries || !enabled {
+		t.Fatalf("expected default retry, got %d %t", limit, enabled)
+	}
+
+	out, _ := json.Marshal(job)
+	if !strings.HasPrefix(string(out), `{"class":"RubyWorker","args":[42,"x"],"retry":true,"queue":"go","jid":"`) {
+		t.Fatalf("unexpected payload: %s", out)
+	}
+}
+
+func TestNewJobRequiresClass(t *testing.T) {
+	if _, err := newJob("", nil, enqueueOptions{}, time.Now()); err == nil {
+		t.Fatalf("expected error without class")
+	}
+}
+
+func TestEnqueuePushesOntoQueue(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	job, _ := newJob("RubyWorker", []any{1}, enqueueOptions{}, now)
+
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:0\r\n:1\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+	jid, err := enqueue(rw, job, time.Time{}, now)
+	if err != nil {
+		t.Fatalf("enqueue error: %v", err)
+	}
+	cmd := out.String()
+	for _, want := range []string{
+		"$4\r\nSADD\r\n$6\r\nqueues\r\n$7\r\ndefault\r\n",
+		"$5\r\nLPUSH\r\n$13\r\nqueue:default\r\n",
+		`"enqueued_at":1700000000`,
+		jid,
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Fatalf("expected %q in %q", want, cmd)
+		}
+	}
+}
+
+func TestEnqueueSchedulesFutureJob(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	job, _ := newJob("RubyWorker", []any{1}, enqueueOptions{}, now)
+
+	out := bytes.NewBuffer(nil)
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(":1\r\n")), bufio.NewWriter(out))
+	if _, err := enqueue(rw, job, now.Add(time.Minute), now); err != nil {
+		t.Fatalf("enqueue error: %v", err)
+	}
+	cmd := out.String()
+	if !strings.Contains(cmd, "$4\r\nZADD\r\n$8\r\nschedule\r\n$17\r\n1700000060.000000\r\n") {
+		t.Fatalf("expected ZADD onto schedule: %q", cmd)
+	}
+	if strings.Contains(cmd, "enqueued_at") {
+		t.Fatalf("scheduled jobs must not carry enqueued_at: %q", cmd)
+	}
+}
+
+func TestParseCLIArgAndRetryOption(t *testing.T) {
+	if got, ok := parseCLIArg("123").(json.RawMessage); !ok || string(got) != "123" {
+		t.Fatalf("expected JSON number, got %#v", parseCLIArg("123"))
+	}
+	if got := parseCLIArg("hello"); got != "hello" {
+		t.Fatalf("expected plain string, got %#v", got)
+	}
+	if v, err := parseRetryOption("false"); err != nil || v != false {
+		t.Fatalf("expected false, got %v %v", v, err)
+	}
+	if v, err := parseRetryOption("5"); err != nil || v != 5 {
+		t.Fatalf("expected 5, got %v %v", v, err)
+	}
+	if _, err := parseRetryOption("-1"); err == nil {
+		t.Fatalf("expected error for negative retry")
+	}
+}
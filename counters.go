@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// statsTTLSeconds is how long Sidekiq keeps the daily stat keys (5 years).
+const statsTTLSeconds = 5 * 365 * 24 * 60 * 60
+
+// jobCounters accumulates processed/failed counts between heartbeats, which
+// flush them to Sidekiq's stat keys in the same MULTI block as the beat, so
+// counting costs no extra round trip per job.
+type jobCounters struct {
+	processed atomic.Int64
+	failed    atomic.Int64
+}
+
+// record counts one finished job; failed jobs count as processed too, as in
+// Sidekiq.
+func (c *jobCounters) record(failed bool) {
+	c.processed.Add(1)
+	if failed {
+		c.failed.Add(1)
+	}
+}
+
+// take returns the counts accumulated since the last flush and resets them.
+func (c *jobCounters) take() (processed, failed int64) {
+	return c.processed.Swap(0), c.failed.Swap(0)
+}
+
+// restore puts back counts whose flush failed so they go out with the next
+// heartbeat.
+func (c *jobCounters) restore(processed, failed int64) {
+	c.processed.Add(processed)
+	c.failed.Add(failed)
+}
+
+// statCommands increments stat:processed, stat:failed and their daily
+// stat:<name>:YYYY-MM-DD keys (UTC), as Sidekiq's stat flush does.
+func statCommands(processed, failed int64, now time.Time) [][]string {
+	if processed == 0 && failed == 0 {
+		return nil
+	}
+	day := now.UTC().Format("2006-01-02")
+	ttl := strconv.Itoa(statsTTLSeconds)
+	var cmds [][]string
+	for _, s := range []struct {
+		name  string
+		count int64
+	}{{"processed", processed}, {"failed", failed}} {
+		n := strconv.FormatInt(s.count, 10)
+		daily := "stat:" + s.name + ":" + day
+		cmds = append(cmds,
+			[]string{"INCRBY", "stat:" + s.name, n},
+			[]string{"INCRBY", daily, n},
+			[]string{"EXPIRE", daily, ttl},
+		)
+	}
+	return cmds
+}
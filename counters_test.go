@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobCountersTakeAndRestore(t *testing.T) {
+	var c jobCounters
+	c.record(false)
+	c.record(true)
+
+	processed, failed := c.take()
+	if processed != 2 || failed != 1 {
+		t.Fatalf("expected 2 processed 1 failed, got %d %d", processed, failed)
+	}
+	if p, f := c.take(); p != 0 || f != 0 {
+		t.Fatalf("expected counters reset after take, got %d %d", p, f)
+	}
+
+	c.restore(processed, failed)
+	if p, f := c.take(); p != 2 || f != 1 {
+		t.Fatalf("expected restored counts, got %d %d", p, f)
+	}
+}
+
+func TestStatCommands(t *testing.T) {
+	if cmds := statCommands(0, 0, time.Now()); cmds != nil {
+		t.Fatalf("expected no commands when nothing was processed, got %v", cmds)
+	}
+
+	cmds := statCommands(3, 1, time.Date(2024, 5, 6, 23, 30, 0, 0, time.FixedZone("x", -2*3600)))
+	if len(cmds) != 6 {
+		t.Fatalf("expected 6 commands, got %d", len(cmds))
+	}
+	want := [][]string{
+		{"INCRBY", "stat:processed", "3"},
+		{"INCRBY", "stat:processed:2024-05-07", "3"},
+		{"EXPIRE", "stat:processed:2024-05-07", "157680000"},
+		{"INCRBY", "stat:failed", "1"},
+		{"INCRBY", "stat:failed:2024-05-07", "1"},
+		{"EXPIRE", "stat:failed:2024-05-07", "157680000"},
+	}
+	for i := range want {
+		for j := range want[i] {
+			if cmds[i][j] != want[i][j] {
+				t.Fatalf("command %d: got %v want %v", i, cmds[i], want[i])
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -31,13 +32,35 @@ func buildDSNFromEnv() (string, error) {
 	return dsn, nil
 }
 
-func existsTestRun(db *sql.DB, id int64) bool {
+func existsTestRun(ctx context.Context, db *sql.DB, id int64) (bool, error) {
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM test_runs WHERE id = $1)", id).Scan(&exists)
-	return err == nil && exists
+	err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM test_runs WHERE id = $1)", id).Scan(&exists)
+	return exists, err
 }
 
-func fetchTaskWindow(db *sql.DB, testRunID int64) (int, int, error) {
+// withAdvisoryLock runs fn while this session holds the Postgres advisory
+// lock key, on a connection pinned for the duration. It returns false without
+// running fn when another session holds the lock.
+func withAdvisoryLock(ctx context.Context, db *sql.DB, key int64, fn func() error) (bool, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		return false, fmt.Errorf("advisory lock failed: %w", err)
+	}
+	if !locked {
+		return false, nil
+	}
+	// Unlock even when ctx has been cancelled by a timeout.
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+	return true, fn()
+}
+
+func fetchTaskWindow(ctx context.Context, db *sql.DB, testRunID int64) (int, int, error) {
 	const q = `
 SELECT tasks.page, tasks.per_page
 FROM tasks
@@ -48,7 +71,7 @@ LIMIT 1`
 
 	var page sql.NullInt64
 	var perPage sql.NullInt64
-	err := db.QueryRow(q, testRunID).Scan(&page, &perPage)
+	err := db.QueryRowContext(ctx, q, testRunID).Scan(&page, &perPage)
 	if err != nil && err != sql.ErrNoRows {
 		return 0, 0, err
 	}
@@ -58,10 +81,10 @@ LIMIT 1`
 	return pg, pp, nil
 }
 
-func fetchSamples(db *sql.DB, page, perPage int) ([]float64, error) {
+func fetchSamples(ctx context.Context, db *sql.DB, page, perPage int) ([]float64, error) {
 	limit, offset := windowLimitOffset(page, perPage)
 
-	rows, err := db.Query("SELECT value FROM samples ORDER BY id ASC LIMIT $1 OFFSET $2", limit, offset)
+	rows, err := db.QueryContext(ctx, "SELECT value FROM samples ORDER BY id ASC LIMIT $1 OFFSET $2", limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -98,13 +121,13 @@ func normalizePositiveInt(value int64, fallback int) int {
 	return int(value)
 }
 
-func insertTestResult(db *sql.DB, testRunID int64, st Stats, durationSeconds float64, memoryBytes float64) error {
+func insertTestResult(ctx context.Context, db *sql.DB, testRunID int64, st Stats, durationSeconds float64, memoryBytes float64) error {
 	const q = `
 INSERT INTO test_results 
   (test_run_id, mean, median, q1, q3, min, max, standard_deviation, duration, memory, created_at, updated_at)
 VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,NOW(),NOW())
 `
-	_, err := db.Exec(q,
+	_, err := db.ExecContext(ctx, q,
 		testRunID,
 		st.Mean, st.Median, st.Q1, st.Q3, st.Min, st.Max, st.StdDev,
 		durationSeconds, memoryBytes,
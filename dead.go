@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Sidekiq's defaults for the morgue: at most 10,000 jobs, kept for 6 months.
+const (
+	deadSetKey  = "dead"
+	deadMaxJobs = 10000
+	deadTimeout = 180 * 24 * time.Hour
+)
+
+// sendsToMorgue reports whether an exhausted job should be kept in the dead
+// set; Sidekiq skips it for jobs enqueued with dead: false.
+func sendsToMorgue(job *sidekiqJob) bool {
+	var dead bool
+	if raw := job.raw("dead"); raw != nil && json.Unmarshal(raw, &dead) == nil {
+		return dead
+	}
+	return true
+}
+
+// killJob adds the job to the dead set and trims the set by age and size in
+// one MULTI block, the same way Sidekiq::DeadSet#kill does.
+func killJob(rw *bufio.ReadWriter, job *sidekiqJob, now time.Time) error {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	cutoff := strconv.FormatFloat(epochSeconds(now.Add(-deadTimeout)), 'f', 6, 64)
+
+	cmds := [][]string{
+		{"ZADD", deadSetKey, formatScore(now), string(payload)},
+		{"ZREMRANGEBYSCORE", deadSetKey, "-inf", cutoff},
+		{"ZREMRANGEBYRANK", deadSetKey, "0", strconv.Itoa(-deadMaxJobs)},
+	}
+	_, err = execMulti(rw, cmds)
+	return err
+}
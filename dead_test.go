@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendsToMorgue(t *testing.T) {
+	if !sendsToMorgue(decodeJob(t, `{"class":"RubyWorker","args":[]}`)) {
+		t.Fatalf("expected jobs to go to the morgue by default")
+	}
+	if sendsToMorgue(decodeJob(t, `{"class":"RubyWorker","args":[],"dead":false}`)) {
+		t.Fatalf("expected dead:false to skip the morgue")
+	}
+}
+
+func TestKillJobTrimsDeadSet(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n:1\r\n:0\r\n:0\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+	job := decodeJob(t, `{"class":"RubyWorker","args":[1],"jid":"j1"}`)
+
+	now := time.Unix(1700000000, 0)
+	if err := killJob(rw, job, now); err != nil {
+		t.Fatalf("killJob error: %v", err)
+	}
+	cmd := out.String()
+	for _, want := range []string{
+		"$4\r\nZADD\r\n$4\r\ndead\r\n$17\r\n1700000000.000000\r\n",
+		"$16\r\nZREMRANGEBYSCORE\r\n$4\r\ndead\r\n$4\r\n-inf\r\n$17\r\n1684448000.000000\r\n",
+		"$15\r\nZREMRANGEBYRANK\r\n$4\r\ndead\r\n$1\r\n0\r\n$6\r\n-10000\r\n",
+		"$4\r\nEXEC\r\n",
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Fatalf("expected %q in commands %q", want, cmd)
+		}
+	}
+}
+
+func TestHandleJobFailureMovesExhaustedJobToDeadSet(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n:1\r\n:0\r\n:0\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+	job := decodeJob(t, `{"class":"RubyWorker","args":[1],"retry":0}`)
+
+	outcome, err := handleJobFailure(rw, job, errors.New("boom"), time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("handleJobFailure error: %v", err)
+	}
+	if outcome != failureDead {
+		t.Fatalf("expected failureDead, got %v", outcome)
+	}
+	if !strings.Contains(out.String(), `"error_message":"boom"`) {
+		t.Fatalf("expected error details in dead payload: %q", out.String())
+	}
+}
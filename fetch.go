@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// workingQueuesKey is a Redis set holding every per-process working list so
+// a later process can find and recover jobs left behind by a dead one.
+const workingQueuesKey = "go_worker:working"
+
+// unitOfWork is a job payload taken from a queue. When it was fetched
+// reliably, working names the list the payload sits in until acknowledged.
+type unitOfWork struct {
+	queue   string
+	payload string
+	working string
+}
+
+type fetcher interface {
+	// retrieveWork blocks for up to a few seconds and returns nil on timeout.
+	retrieveWork(rw *bufio.ReadWriter) (*unitOfWork, error)
+	// acknowledge marks the job as done so it is never handed out again.
+	acknowledge(rw *bufio.ReadWriter, work *unitOfWork) error
+	// requeue pushes unfinished jobs back onto the front of their queues,
+	// as Sidekiq's bulk_requeue does on shutdown.
+	requeue(rw *bufio.ReadWriter, works []*unitOfWork) error
+}
+
+// basicFetch pops jobs with BRPOP; a job is lost if the process dies while
+// it is running.
+type basicFetch struct {
+	queues queueList
+}
+
+func (f basicFetch) retrieveWork(rw *bufio.ReadWriter) (*unitOfWork, error) {
+	args := append(f.queues.fetchOrder(), "5")
+	if err := writeCommand(rw, "BRPOP", args...); err != nil {
+		return nil, err
+	}
+	key, payload, err := readBRPOP(rw)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" && payload == "" {
+		return nil, nil
+	}
+	return &unitOfWork{queue: key, payload: payload}, nil
+}
+
+func (f basicFetch) acknowledge(rw *bufio.ReadWriter, work *unitOfWork) error {
+	return nil
+}
+
+func (f basicFetch) requeue(rw *bufio.ReadWriter, works []*unitOfWork) error {
+	for _, work := range works {
+		if err := writeCommand(rw, "RPUSH", work.queue, work.payload); err != nil {
+			return err
+		}
+		if _, err := readInteger(rw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reliablePause is how long reliableFetch waits after finding every queue
+// empty when it cannot block on a single queue.
+var reliablePause = time.Second
+
+// reliableFetch moves each job into a per-process working list and only
+// removes it from there once it has been acknowledged. A single queue is
+// fetched with a blocking BRPOPLPUSH; since that command takes one source,
+// several queues are checked in fetch order with RPOPLPUSH instead.
+type reliableFetch struct {
+	queues   queueList
+	identity string
+}
+
+func (f reliableFetch) retrieveWork(rw *bufio.ReadWriter) (*unitOfWork, error) {
+	order := f.queues.fetchOrder()
+	if len(order) == 1 {
+		working := workingQueueKey(order[0], f.identity)
+		if err := writeCommand(rw, "BRPOPLPUSH", order[0], working, "5"); err != nil {
+			return nil, err
+		}
+		payload, err := readBulkString(rw.Reader)
+		if err != nil || payload == "" {
+			return nil, err
+		}
+		return &unitOfWork{queue: order[0], payload: payload, working: working}, nil
+	}
+	for _, queue := range order {
+		working := workingQueueKey(queue, f.identity)
+		if err := writeCommand(rw, "RPOPLPUSH", queue, working); err != nil {
+			return nil, err
+		}
+		payload, err := readBulkString(rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if payload != "" {
+			return &unitOfWork{queue: queue, payload: payload, working: working}, nil
+		}
+	}
+	time.Sleep(reliablePause)
+	return nil, nil
+}
+
+func (f reliableFetch) acknowledge(rw *bufio.ReadWriter, work *unitOfWork) error {
+	if err := writeCommand(rw, "LREM", work.working, "-1", work.payload); err != nil {
+		return err
+	}
+	_, err := readInteger(rw)
+	return err
+}
+
+// requeue moves each job from its working list back onto the front of its
+// queue in one transaction, so it is never in both or neither.
+func (f reliableFetch) requeue(rw *bufio.ReadWriter, works []*unitOfWork) error {
+	for _, work := range works {
+		cmds := [][]string{
+			{"RPUSH", work.queue, work.payload},
+			{"LREM", work.working, "-1", work.payload},
+		}
+		if _, err := execMulti(rw, cmds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reenqueue puts a job back at the tail of its queue, behind the jobs
+// already waiting, and removes it from its working list if it has one.
+func reenqueue(rw *bufio.ReadWriter, work *unitOfWork) error {
+	cmds := [][]string{{"LPUSH", work.queue, work.payload}}
+	if work.working != "" {
+		cmds = append(cmds, []string{"LREM", work.working, "-1", work.payload})
+	}
+	_, err := execMulti(rw, cmds)
+	return err
+}
+
+// forward moves a job to another queue, e.g. one served by Ruby Sidekiq,
+// rewriting its "queue" field to match.
+func forward(rw *bufio.ReadWriter, work *unitOfWork, job *sidekiqJob, queue string) error {
+	job.Queue = queue
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	cmds := [][]string{
+		{"SADD", "queues", queue},
+		{"LPUSH", "queue:" + queue, string(payload)},
+	}
+	if work.working != "" {
+		cmds = append(cmds, []string{"LREM", work.working, "-1", work.payload})
+	}
+	_, err = execMulti(rw, cmds)
+	return err
+}
+
+// register records the working lists so they can be found by recovery sweeps.
+func (f reliableFetch) register(rw *bufio.ReadWriter) error {
+	args := []string{workingQueuesKey}
+	for _, queue := range f.queues.keys() {
+		args = append(args, workingQueueKey(queue, f.identity))
+	}
+	if err := writeCommand(rw, "SADD", args...); err != nil {
+		return err
+	}
+	_, err := readInteger(rw)
+	return err
+}
+
+func workingQueueKey(queue, identity string) string {
+	return queue + "|working|" + identity
+}
+
+// parseWorkingQueueKey splits a working list key back into its source queue
+// and owning process identity.
+func parseWorkingQueueKey(key string) (queue, identity string, ok bool) {
+	return strings.Cut(key, "|working|")
+}
+
+// recoverWorkingScript moves a whole working list back onto the front of its
+// queue, oldest job nearest the front, as requeue does on shutdown. The
+// working list holds its oldest job at the tail, so popping from the head
+// and pushing onto the queue's tail keeps the original order.
+const recoverWorkingScript = `local n = 0
+while true do
+  local job = redis.call("lpop", KEYS[1])
+  if not job then return n end
+  redis.call("rpush", KEYS[2], job)
+  n = n + 1
+end`
+
+var recoverWorkingScriptSHA = scriptSHA(recoverWorkingScript)
+
+// recoverOrphanedWork pushes jobs found in working lists of processes whose
+// heartbeat hash has expired back onto the front of their source queue, so
+// they run before jobs enqueued since. It returns the number of jobs
+// recovered.
+func recoverOrphanedWork(rw *bufio.ReadWriter, identity string) (int, error) {
+	if err := writeCommand(rw, "SMEMBERS", workingQueuesKey); err != nil {
+		return 0, err
+	}
+	keys, err := readStringArray(rw)
+	if err != nil {
+		return 0, err
+	}
+	recovered := 0
+	for _, key := range keys {
+		queue, owner, ok := parseWorkingQueueKey(key)
+		if !ok || owner == identity {
+			continue
+		}
+		if err := writeCommand(rw, "EXISTS", owner); err != nil {
+			return recovered, err
+		}
+		alive, err := readInteger(rw)
+		if err != nil {
+			return recovered, err
+		}
+		if alive > 0 {
+			continue
+		}
+		n, err := evalScript(rw, recoverWorkingScript, recoverWorkingScriptSHA, []string{key, queue})
+		if err != nil {
+			return recovered, err
+		}
+		recovered += int(n)
+		if err := writeCommand(rw, "SREM", workingQueuesKey, key); err != nil {
+			return recovered, err
+		}
+		if _, err := readInteger(rw); err != nil {
+			return recovered, err
+		}
+	}
+	return recovered, nil
+}
+
+// processIdentity follows Sidekiq's hostname:pid:nonce identity format.
+func processIdentity() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	nonce := make([]byte, 6)
+	_, _ = rand.Read(nonce)
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(nonce))
+}
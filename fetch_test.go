@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkingQueueKeyRoundTrip(t *testing.T) {
+	key := workingQueueKey("queue:default", "host:12:abcdef")
+	queue, identity, ok := parseWorkingQueueKey(key)
+	if !ok {
+		t.Fatalf("expected %q to parse", key)
+	}
+	if queue != "queue:default" || identity != "host:12:abcdef" {
+		t.Fatalf("unexpected parse result: %q %q", queue, identity)
+	}
+}
+
+func TestProcessIdentityFormat(t *testing.T) {
+	parts := strings.Split(processIdentity(), ":")
+	if len(parts) != 3 {
+		t.Fatalf("expected hostname:pid:nonce, got %v", parts)
+	}
+	if len(parts[2]) != 12 {
+		t.Fatalf("expected 12 hex nonce chars, got %q", parts[2])
+	}
+}
+
+func TestReliableFetchRetrieveWork(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	in := bytes.NewBufferString("$11\r\n{\"args\":[]}\r\n")
+	rw := bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(out))
+
+	f := reliableFetch{queues: queueList{names: []string{"go"}, weights: []int{0}, strict: true}, identity: "h:1:aa"}
+	work, err := f.retrieveWork(rw)
+	if err != nil {
+		t.Fatalf("retrieveWork error: %v", err)
+	}
+	if work == nil || work.payload != `{"args":[]}` {
+		t.Fatalf("unexpected work: %#v", work)
+	}
+	if work.working != "queue:go|working|h:1:aa" {
+		t.Fatalf("unexpected working list: %q", work.working)
+	}
+	want := "*4\r\n$10\r\nBRPOPLPUSH\r\n$8\r\nqueue:go\r\n$23\r\nqueue:go|working|h:1:aa\r\n$1\r\n5\r\n"
+	if got := out.String(); got != want {
+		t.Fatalf("unexpected command. got %q want %q", got, want)
+	}
+}
+
+func TestReliableFetchRetrieveWorkTimeout(t *testing.T) {
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString("$-1\r\n")), bufio.NewWriter(bytes.NewBuffer(nil)))
+
+	f := reliableFetch{queues: queueList{names: []string{"go"}, weights: []int{0}, strict: true}, identity: "h:1:aa"}
+	work, err := f.retrieveWork(rw)
+	if err != nil {
+		t.Fatalf("retrieveWork error: %v", err)
+	}
+	if work != nil {
+		t.Fatalf("expected nil work on timeout, got %#v", work)
+	}
+}
+
+func TestReliableFetchMultipleQueuesUsesRPOPLPUSH(t *testing.T) {
+	reliablePause = 0
+	t.Cleanup(func() { reliablePause = time.Second })
+
+	out := bytes.NewBuffer(nil)
+	in := bytes.NewBufferString("$-1\r\n$2\r\n{}\r\n")
+	rw := bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(out))
+
+	ql, _ := parseQueueList("critical,go")
+	work, err := reliableFetch{queues: ql, identity: "h:1:aa"}.retrieveWork(rw)
+	if err != nil {
+		t.Fatalf("retrieveWork error: %v", err)
+	}
+	if work == nil || work.queue != "queue:go" || work.working != "queue:go|working|h:1:aa" {
+		t.Fatalf("unexpected work: %#v", work)
+	}
+	cmd := out.String()
+	if strings.Count(cmd, "RPOPLPUSH") != 2 || !strings.Contains(cmd, "queue:critical|working|h:1:aa") {
+		t.Fatalf("expected RPOPLPUSH on both queues in order: %q", cmd)
+	}
+}
+
+func TestBasicFetchBRPOPListsAllQueues(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString("*-1\r\n")), bufio.NewWriter(out))
+
+	ql, _ := parseQueueList("critical,go")
+	if _, err := (basicFetch{queues: ql}).retrieveWork(rw); err != nil {
+		t.Fatalf("retrieveWork error: %v", err)
+	}
+	want := "*4\r\n$5\r\nBRPOP\r\n$14\r\nqueue:critical\r\n$8\r\nqueue:go\r\n$1\r\n5\r\n"
+	if out.String() != want {
+		t.Fatalf("unexpected command. got %q want %q", out.String(), want)
+	}
+}
+
+func TestRecoverOrphanedWorkPushesToFront(t *testing.T) {
+	rw, out := fakeRedis("*1\r\n$25\r\nqueue:go|working|h:9:dead\r\n:0\r\n:2\r\n:1\r\n")
+	n, err := recoverOrphanedWork(rw, "h:1:aa")
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 recovered jobs, got %d %v", n, err)
+	}
+	want := "*5\r\n$7\r\nEVALSHA\r\n$40\r\n" + recoverWorkingScriptSHA + "\r\n$1\r\n2\r\n$25\r\nqueue:go|working|h:9:dead\r\n$8\r\nqueue:go\r\n"
+	if !strings.Contains(out.String(), want) {
+		t.Fatalf("expected the working list to be moved by script: %q", out.String())
+	}
+	if strings.Contains(out.String(), "RPOPLPUSH") {
+		t.Fatalf("expected no RPOPLPUSH, which appends to the back of the queue: %q", out.String())
+	}
+}
+
+func TestRecoverOrphanedWorkSkipsLiveProcesses(t *testing.T) {
+	rw, out := fakeRedis("*3\r\n$23\r\nqueue:go|working|h:1:aa\r\n$23\r\nqueue:go|working|h:2:bb\r\n$23\r\nqueue:go|working|h:3:cc\r\n" +
+		":1\r\n" + // h:2:bb is alive
+		":0\r\n:3\r\n:1\r\n") // h:3:cc is dead: 3 jobs moved, list unregistered
+	n, err := recoverOrphanedWork(rw, "h:1:aa")
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 recovered jobs, got %d %v", n, err)
+	}
+	cmd := out.String()
+	if strings.Contains(cmd, "$6\r\nh:1:aa\r\n") {
+		t.Fatalf("expected the sweep to skip its own working lists: %q", cmd)
+	}
+	if strings.Count(cmd, "EXISTS") != 2 || strings.Count(cmd, "EVALSHA") != 1 {
+		t.Fatalf("expected only the dead process' list to be recovered: %q", cmd)
+	}
+	want := "*3\r\n$4\r\nSREM\r\n$17\r\ngo_worker:working\r\n$23\r\nqueue:go|working|h:3:cc\r\n"
+	if !strings.HasSuffix(cmd, want) {
+		t.Fatalf("expected the drained list to be unregistered: %q", cmd)
+	}
+}
+
+func TestReliableFetchAcknowledge(t *testing.T) {
+	rw, out := fakeRedis(":1\r\n")
+	work := &unitOfWork{queue: "queue:go", payload: "{}", working: "queue:go|working|h:1:aa"}
+	if err := (reliableFetch{}).acknowledge(rw, work); err != nil {
+		t.Fatalf("acknowledge error: %v", err)
+	}
+	want := "*4\r\n$4\r\nLREM\r\n$23\r\nqueue:go|working|h:1:aa\r\n$2\r\n-1\r\n$2\r\n{}\r\n"
+	if out.String() != want {
+		t.Fatalf("unexpected command. got %q want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	processesKey = "processes"
+	beatInterval = 10 * time.Second
+	// processTTLSeconds matches Sidekiq's 60 second expiry on the process
+	// and work hashes, so a dead process drops off the Busy page.
+	processTTLSeconds = 60
+	// recoverySweepInterval is how often reliable fetch looks for jobs left
+	// behind by processes that died after this one started.
+	recoverySweepInterval = time.Minute
+)
+
+// processInfo is the "info" JSON Sidekiq's Web UI reads from the process
+// hash.
+type processInfo struct {
+	Hostname    string           `json:"hostname"`
+	StartedAt   float64          `json:"started_at"`
+	Pid         int              `json:"pid"`
+	Tag         string           `json:"tag"`
+	Concurrency int              `json:"concurrency"`
+	Queues      []string         `json:"queues"`
+	Weights     []map[string]int `json:"weights"`
+	Labels      []string         `json:"labels"`
+	Identity    string           `json:"identity"`
+	Version     string           `json:"version"`
+	Embedded    bool             `json:"embedded"`
+}
+
+func newProcessInfo(identity string, queues queueList, concurrency int, now time.Time) processInfo {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	tag := os.Getenv("WORKER_TAG")
+	if tag == "" {
+		if wd, err := os.Getwd(); err == nil {
+			tag = filepath.Base(wd)
+		}
+	}
+	return processInfo{
+		Hostname:    host,
+		StartedAt:   epochSeconds(now),
+		Pid:         os.Getpid(),
+		Tag:         tag,
+		Concurrency: concurrency,
+		Queues:      queues.names,
+		Weights:     []map[string]int{queues.weightMap()},
+		Labels:      []string{},
+		Identity:    identity,
+		Version:     "go_worker",
+	}
+}
+
+// workState tracks the jobs currently running in this process, keyed by
+// processor id, for the <identity>:work hash and for requeueing on shutdown.
+type workState struct {
+	mu    sync.Mutex
+	jobs  map[string]string
+	units map[string]*unitOfWork
+}
+
+func newWorkState() *workState {
+	return &workState{jobs: map[string]string{}, units: map[string]*unitOfWork{}}
+}
+
+// start records a running job in the format Sidekiq writes to the work hash.
+func (w *workState) start(tid string, work *unitOfWork, now time.Time) {
+	entry, _ := json.Marshal(struct {
+		Queue   string `json:"queue"`
+		Payload string `json:"payload"`
+		RunAt   int64  `json:"run_at"`
+	}{strings.TrimPrefix(work.queue, "queue:"), work.payload, now.Unix()})
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.jobs[tid] = string(entry)
+	w.units[tid] = work
+}
+
+func (w *workState) finish(tid string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.jobs, tid)
+	delete(w.units, tid)
+}
+
+// inProgress returns the jobs that have started but not finished.
+func (w *workState) inProgress() []*unitOfWork {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := make([]*unitOfWork, 0, len(w.units))
+	for _, u := range w.units {
+		out = append(out, u)
+	}
+	return out
+}
+
+func (w *workState) snapshot() map[string]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := make(map[string]string, len(w.jobs))
+	for k, v := range w.jobs {
+		out[k] = v
+	}
+	return out
+}
+
+// newTID returns a short base36 id like the thread ids Sidekiq uses as keys
+// in the work hash.
+func newTID() string {
+	return strconv.FormatInt(rand.Int63n(1<<40), 36)
+}
+
+type heartbeat struct {
+	client   *redisClient
+	identity string
+	info     processInfo
+	work     *workState
+	stats    *jobCounters
+	life     *lifecycle
+	// signals receives the process signals requested from the Web UI.
+	signals chan<- os.Signal
+	// reliable enables the periodic sweep for orphaned working lists.
+	reliable bool
+}
+
+// run beats every beatInterval until the service starts shutting down. With
+// reliable fetch it also sweeps for orphaned jobs every
+// recoverySweepInterval, since a process that dies is only seen as dead once
+// its hash expires, after the startup sweep of its replacement has run.
+func (h heartbeat) run() {
+	lastSweep := time.Now()
+	for {
+		var name string
+		err := h.client.withConn(func(rw *bufio.ReadWriter) error {
+			var err error
+			name, err = h.beat(rw, time.Now())
+			return err
+		})
+		if err != nil {
+			log.Printf("[go_worker] heartbeat error: %v", err)
+		} else if name != "" {
+			h.deliver(name)
+		}
+		if h.reliable && time.Since(lastSweep) >= recoverySweepInterval {
+			lastSweep = time.Now()
+			h.sweep()
+		}
+		if !h.life.sleep(beatInterval) {
+			return
+		}
+	}
+}
+
+// sweep pushes jobs from the working lists of dead processes back onto
+// their queues.
+func (h heartbeat) sweep() {
+	var n int
+	err := h.client.withConn(func(rw *bufio.ReadWriter) error {
+		var err error
+		n, err = recoverOrphanedWork(rw, h.identity)
+		return err
+	})
+	if err != nil {
+		log.Printf("[go_worker] recovery sweep error: %v", err)
+	} else if n > 0 {
+		log.Printf("[go_worker] recovered %d orphaned jobs", n)
+	}
+}
+
+// webSignals maps the signal names the Web UI pushes to <identity>-signals
+// onto the process signals they stand for.
+var webSignals = map[string]os.Signal{
+	"TSTP": syscall.SIGTSTP,
+	"TERM": syscall.SIGTERM,
+}
+
+// deliver hands a Web UI signal to the service's signal handling, so Quiet
+// and Stop behave exactly like SIGTSTP and SIGTERM sent to the process.
+func (h heartbeat) deliver(name string) {
+	sig, ok := webSignals[name]
+	if !ok {
+		log.Printf("[go_worker] ignoring unsupported signal %s from the Web UI", name)
+		return
+	}
+	log.Printf("[go_worker] received %s from the Web UI", name)
+	select {
+	case h.signals <- sig:
+	case <-h.life.stopCh:
+	}
+}
+
+// clear flushes the remaining counters and removes this process from the
+// Busy page, like Sidekiq's clear_heartbeat on shutdown.
+func (h heartbeat) clear(rw *bufio.ReadWriter, now time.Time) error {
+	processed, failed := h.stats.take()
+	cmds := [][]string{
+		{"SREM", processesKey, h.identity},
+		{"DEL", h.identity, h.identity + ":work"},
+	}
+	cmds = append(cmds, statCommands(processed, failed, now)...)
+	_, err := execMulti(rw, cmds)
+	return err
+}
+
+// beat refreshes this process' entry in the processes set, its hash and the
+// work hash, flushes the job counters and pops the oldest signal the Web UI
+// sent to <identity>-signals, in one MULTI block, mirroring
+// Sidekiq::Launcher#heartbeat. It returns the signal name, or "".
+func (h heartbeat) beat(rw *bufio.ReadWriter, now time.Time) (string, error) {
+	info, err := json.Marshal(h.info)
+	if err != nil {
+		return "", err
+	}
+	work := h.work.snapshot()
+	workKey := h.identity + ":work"
+	ttl := strconv.Itoa(processTTLSeconds)
+
+	cmds := [][]string{
+		{"SADD", processesKey, h.identity},
+		{"HSET", h.identity,
+			"info", string(info),
+			"busy", strconv.Itoa(len(work)),
+			"beat", formatScore(now),
+			"rtt_us", "0",
+			"quiet", strconv.FormatBool(h.life.isQuiet()),
+			"rss", strconv.FormatInt(int64(rssBytesFunc()/1024), 10),
+		},
+		{"EXPIRE", h.identity, ttl},
+		{"DEL", workKey},
+	}
+	if len(work) > 0 {
+		hset := []string{"HSET", workKey}
+		for tid, entry := range work {
+			hset = append(hset, tid, entry)
+		}
+		cmds = append(cmds, hset, []string{"EXPIRE", workKey, ttl})
+	}
+
+	processed, failed := h.stats.take()
+	cmds = append(cmds, statCommands(processed, failed, now)...)
+	cmds = append(cmds, []string{"RPOP", h.identity + "-signals"})
+
+	replies, err := execMulti(rw, cmds)
+	if err != nil {
+		h.stats.restore(processed, failed)
+		return "", err
+	}
+	signal, _ := replies[len(replies)-1].text()
+	return signal, nil
+}
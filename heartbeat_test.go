@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWorkStateStartFinish(t *testing.T) {
+	w := newWorkState()
+	unit := &unitOfWork{queue: "queue:go", payload: `{"class":"RubyWorker","args":[7]}`}
+	w.start("abc", unit, time.Unix(1700000000, 0))
+
+	snap := w.snapshot()
+	var entry struct {
+		Queue   string `json:"queue"`
+		Payload string `json:"payload"`
+		RunAt   int64  `json:"run_at"`
+	}
+	if err := json.Unmarshal([]byte(snap["abc"]), &entry); err != nil {
+		t.Fatalf("work entry is not JSON: %v", err)
+	}
+	if entry.Queue != "go" || entry.RunAt != 1700000000 || !strings.Contains(entry.Payload, "RubyWorker") {
+		t.Fatalf("unexpected work entry: %#v", entry)
+	}
+
+	if got := w.inProgress(); len(got) != 1 || got[0] != unit {
+		t.Fatalf("expected the started job in progress, got %v", got)
+	}
+
+	w.finish("abc")
+	if len(w.snapshot()) != 0 || len(w.inProgress()) != 0 {
+		t.Fatalf("expected no running jobs after finish")
+	}
+}
+
+func TestHeartbeatBeat(t *testing.T) {
+	rssBytesFunc = func() float64 { return 2048 }
+	t.Cleanup(func() { rssBytesFunc = rssBytes })
+
+	work := newWorkState()
+	work.start("tid1", &unitOfWork{queue: "queue:go", payload: `{"class":"RubyWorker"}`}, time.Unix(1700000000, 0))
+	h := heartbeat{
+		identity: "host:1:aa",
+		info:     newProcessInfo("host:1:aa", queueList{names: []string{"go"}, weights: []int{0}, strict: true}, 1, time.Unix(1700000000, 0)),
+		work:     work,
+		stats:    &jobCounters{},
+		life:     newLifecycle(),
+	}
+	h.stats.record(false)
+	h.life.quiet()
+
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n" + strings.Repeat("+QUEUED\r\n", 13) + "*13\r\n" + strings.Repeat(":1\r\n", 12) + "$4\r\nTSTP\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+
+	signal, err := h.beat(rw, time.Unix(1700000010, 0))
+	if err != nil {
+		t.Fatalf("beat error: %v", err)
+	}
+	if signal != "TSTP" {
+		t.Fatalf("expected the popped signal, got %q", signal)
+	}
+	cmd := out.String()
+	for _, want := range []string{
+		"$4\r\nSADD\r\n$9\r\nprocesses\r\n$9\r\nhost:1:aa\r\n",
+		"$4\r\nbusy\r\n$1\r\n1\r\n",
+		"$4\r\nbeat\r\n$17\r\n1700000010.000000\r\n",
+		"$3\r\nrss\r\n$1\r\n2\r\n",
+		"$5\r\nquiet\r\n$4\r\ntrue\r\n",
+		"$6\r\nEXPIRE\r\n$9\r\nhost:1:aa\r\n$2\r\n60\r\n",
+		"$14\r\nhost:1:aa:work\r\n$4\r\ntid1\r\n",
+		`"queues":["go"]`,
+		"$6\r\nINCRBY\r\n$14\r\nstat:processed\r\n$1\r\n1\r\n",
+		"$4\r\nRPOP\r\n$17\r\nhost:1:aa-signals\r\n",
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Fatalf("expected %q in %q", want, cmd)
+		}
+	}
+}
+
+func TestHeartbeatBeatRestoresCountersOnError(t *testing.T) {
+	h := heartbeat{identity: "host:1:aa", work: newWorkState(), stats: &jobCounters{}, life: newLifecycle()}
+	h.stats.record(true)
+
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString("-ERR nope\r\n")), bufio.NewWriter(bytes.NewBuffer(nil)))
+	if _, err := h.beat(rw, time.Now()); err == nil {
+		t.Fatalf("expected beat error")
+	}
+	if p, f := h.stats.take(); p != 1 || f != 1 {
+		t.Fatalf("expected counters restored, got %d %d", p, f)
+	}
+}
+
+func TestHeartbeatClear(t *testing.T) {
+	h := heartbeat{identity: "host:1:aa", work: newWorkState(), stats: &jobCounters{}, life: newLifecycle()}
+
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:1\r\n:2\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+	if err := h.clear(rw, time.Now()); err != nil {
+		t.Fatalf("clear error: %v", err)
+	}
+	for _, want := range []string{
+		"$4\r\nSREM\r\n$9\r\nprocesses\r\n$9\r\nhost:1:aa\r\n",
+		"$3\r\nDEL\r\n$9\r\nhost:1:aa\r\n$14\r\nhost:1:aa:work\r\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in %q", want, out.String())
+		}
+	}
+}
+
+func TestHeartbeatBeatWithoutSignal(t *testing.T) {
+	h := heartbeat{identity: "host:1:aa", work: newWorkState(), stats: &jobCounters{}, life: newLifecycle()}
+
+	replies := "+OK\r\n" + strings.Repeat("+QUEUED\r\n", 5) + "*5\r\n" + strings.Repeat(":1\r\n", 4) + "$-1\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(bytes.NewBuffer(nil)))
+	if signal, err := h.beat(rw, time.Now()); err != nil || signal != "" {
+		t.Fatalf("expected no signal, got %q %v", signal, err)
+	}
+}
+
+func TestHeartbeatDeliver(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	h := heartbeat{life: newLifecycle(), signals: signals}
+
+	h.deliver("TERM")
+	if sig := <-signals; sig != syscall.SIGTERM {
+		t.Fatalf("expected SIGTERM, got %v", sig)
+	}
+
+	h.deliver("TTIN")
+	select {
+	case sig := <-signals:
+		t.Fatalf("expected unsupported signal to be ignored, got %v", sig)
+	default:
+	}
+
+	// Once stopping, delivery must not block even if nobody is listening.
+	signals <- syscall.SIGINT
+	h.life.stop()
+	h.deliver("TSTP")
+}
+
+func TestHeartbeatSweepRecoversOrphanedWork(t *testing.T) {
+	s := &pipeServer{reply: func(cmd string) string {
+		switch cmd {
+		case "SMEMBERS":
+			return "*1\r\n$23\r\nqueue:go|working|h:3:cc\r\n"
+		case "EXISTS":
+			return ":0\r\n"
+		default:
+			return ":1\r\n"
+		}
+	}}
+	c, _ := newPipeClient(1, time.Minute, s)
+	defer c.close()
+
+	heartbeat{client: c, identity: "h:1:aa", reliable: true}.sweep()
+	got := strings.Join(s.seen(), ",")
+	if got != "SMEMBERS,EXISTS,EVALSHA,SREM" {
+		t.Fatalf("unexpected commands: %s", got)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// sidekiqJob is a decoded Sidekiq payload. Besides the typed fields, it
+// keeps every key of the original payload in order so the job can be written
+// back to Redis (retry set, dead set, queues) without losing data.
+type sidekiqJob struct {
+	Class string
+	Args  []json.RawMessage
+	Queue string
+	JID   string
+	// CreatedAt and EnqueuedAt are epoch timestamps as Sidekiq writes them:
+	// float seconds, or integer milliseconds since Sidekiq 8.
+	CreatedAt  float64
+	EnqueuedAt float64
+	// Retry is the raw retry option: true, false or a retry limit.
+	Retry json.RawMessage
+	Tags  []string
+	// BID is the Sidekiq Pro batch id, if the job belongs to a batch.
+	BID string
+
+	fields []payloadField
+}
+
+type payloadField struct {
+	key   string
+	value json.RawMessage
+}
+
+func (j *sidekiqJob) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("job payload is not a JSON object")
+	}
+	var fields []payloadField
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		fields = append(fields, payloadField{key: key, value: value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	*j = sidekiqJob{fields: fields}
+	if err := j.get("class", &j.Class); err != nil {
+		return fmt.Errorf("class: %w", err)
+	}
+	if err := j.get("args", &j.Args); err != nil {
+		return fmt.Errorf("args: %w", err)
+	}
+	if err := j.get("queue", &j.Queue); err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	if err := j.get("jid", &j.JID); err != nil {
+		return fmt.Errorf("jid: %w", err)
+	}
+	if err := j.get("created_at", &j.CreatedAt); err != nil {
+		return fmt.Errorf("created_at: %w", err)
+	}
+	if err := j.get("enqueued_at", &j.EnqueuedAt); err != nil {
+		return fmt.Errorf("enqueued_at: %w", err)
+	}
+	if raw := j.raw("retry"); raw != nil {
+		j.Retry = append(json.RawMessage(nil), raw...)
+	}
+	if err := j.get("tags", &j.Tags); err != nil {
+		return fmt.Errorf("tags: %w", err)
+	}
+	if err := j.get("bid", &j.BID); err != nil {
+		return fmt.Errorf("bid: %w", err)
+	}
+	return nil
+}
+
+func (j sidekiqJob) MarshalJSON() ([]byte, error) {
+	out := j.clone()
+	out.set("class", out.Class)
+	if out.Args == nil {
+		out.Args = []json.RawMessage{}
+	}
+	out.set("args", out.Args)
+	out.sync("retry", out.Retry, out.Retry != nil)
+	out.sync("queue", out.Queue, out.Queue != "")
+	out.sync("jid", out.JID, out.JID != "")
+	out.sync("created_at", out.CreatedAt, out.CreatedAt != 0)
+	out.sync("enqueued_at", out.EnqueuedAt, out.EnqueuedAt != 0)
+	out.sync("tags", out.Tags, out.Tags != nil)
+	out.sync("bid", out.BID, out.BID != "")
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range out.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(f.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (j *sidekiqJob) clone() *sidekiqJob {
+	c := *j
+	c.fields = append([]payloadField(nil), j.fields...)
+	return &c
+}
+
+func (j *sidekiqJob) has(key string) bool {
+	return j.raw(key) != nil
+}
+
+func (j *sidekiqJob) raw(key string) json.RawMessage {
+	for _, f := range j.fields {
+		if f.key == key {
+			return f.value
+		}
+	}
+	return nil
+}
+
+// get decodes the payload key into v, leaving v untouched if the key is
+// absent or null.
+func (j *sidekiqJob) get(key string, v any) error {
+	raw := j.raw(key)
+	if raw == nil || string(raw) == "null" {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// sync writes a typed field back into the payload when it is set or the key
+// already exists, leaving the original encoding alone if the value has not
+// changed (so 1700000000.5 is not rewritten as 1.7000000005e+09).
+func (j *sidekiqJob) sync(key string, v any, set bool) {
+	raw := j.raw(key)
+	if raw == nil && !set {
+		return
+	}
+	if raw != nil {
+		encoded, err := json.Marshal(v)
+		if err == nil && sameJSON(raw, encoded) {
+			return
+		}
+	}
+	j.set(key, v)
+}
+
+func sameJSON(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// latency is how long the job waited in its queue before now, or zero when
+// it carries no enqueued_at.
+func (j *sidekiqJob) latency(now time.Time) time.Duration {
+	if j.EnqueuedAt == 0 {
+		return 0
+	}
+	return now.Sub(epochTime(j.EnqueuedAt))
+}
+
+// epochTime reads a Sidekiq timestamp, telling integer milliseconds apart
+// from float seconds by magnitude.
+func epochTime(v float64) time.Time {
+	if v > 1e11 {
+		return time.UnixMilli(int64(v))
+	}
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9))
+}
+
+// set replaces the payload key, appending it when it is new.
+func (j *sidekiqJob) set(key string, v any) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		// Only called with plain values; a failure here is a programming error.
+		panic(fmt.Sprintf("encode job field %s: %v", key, err))
+	}
+	for i, f := range j.fields {
+		if f.key == key {
+			j.fields[i].value = raw
+			return
+		}
+	}
+	j.fields = append(j.fields, payloadField{key: key, value: raw})
+}
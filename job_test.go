@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSidekiqJobRoundTripKeepsUnknownFields(t *testing.T) {
+	payload := `{"retry":true,"queue":"go","class":"RubyWorker","args":[42],"jid":"abc123","created_at":1700000000.5,"custom":{"a":[1,2]}}`
+
+	var job sidekiqJob
+	if err := json.Unmarshal([]byte(payload), &job); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if job.Class != "RubyWorker" || job.Queue != "go" || len(job.Args) != 1 {
+		t.Fatalf("unexpected decoded job: %#v", job)
+	}
+
+	out, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if string(out) != payload {
+		t.Fatalf("round trip changed payload.\n got %s\nwant %s", out, payload)
+	}
+}
+
+func TestSidekiqJobSetAppendsAndReplaces(t *testing.T) {
+	var job sidekiqJob
+	if err := json.Unmarshal([]byte(`{"class":"GoWorker","args":["7"]}`), &job); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	job.set("retry_count", 0)
+	job.set("retry_count", 1)
+	job.Queue = "critical"
+
+	out, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	want := `{"class":"GoWorker","args":["7"],"retry_count":1,"queue":"critical"}`
+	if string(out) != want {
+		t.Fatalf("unexpected payload.\n got %s\nwant %s", out, want)
+	}
+}
+
+func TestSidekiqJobRejectsNonObject(t *testing.T) {
+	var job sidekiqJob
+	if err := json.Unmarshal([]byte(`[1,2]`), &job); err == nil {
+		t.Fatalf("expected error for non-object payload")
+	}
+}
+
+func TestSidekiqJobTypedFields(t *testing.T) {
+	payload := `{"class":"RubyWorker","args":[42],"retry":3,"queue":"go","jid":"abc123","created_at":1700000000123,"enqueued_at":1700000005123,"tags":["bench"],"bid":"b-1","custom":true}`
+
+	var job sidekiqJob
+	if err := json.Unmarshal([]byte(payload), &job); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if job.JID != "abc123" || job.BID != "b-1" || len(job.Tags) != 1 || string(job.Retry) != "3" {
+		t.Fatalf("unexpected typed fields: %#v", job)
+	}
+	if job.CreatedAt != 1700000000123 || job.EnqueuedAt != 1700000005123 {
+		t.Fatalf("unexpected timestamps: %v %v", job.CreatedAt, job.EnqueuedAt)
+	}
+
+	out, _ := json.Marshal(job)
+	if string(out) != payload {
+		t.Fatalf("round trip changed payload.\n got %s\nwant %s", out, payload)
+	}
+
+	job.EnqueuedAt = 1700000010.5
+	job.Tags = append(job.Tags, "go")
+	out, _ = json.Marshal(job)
+	want := `{"class":"RubyWorker","args":[42],"retry":3,"queue":"go","jid":"abc123","created_at":1700000000123,"enqueued_at":1700000010.5,"tags":["bench","go"],"bid":"b-1","custom":true}`
+	if string(out) != want {
+		t.Fatalf("unexpected payload.\n got %s\nwant %s", out, want)
+	}
+}
+
+func TestSidekiqJobLatency(t *testing.T) {
+	now := time.Unix(1700000010, 0)
+	for _, enqueuedAt := range []float64{1700000007.5, 1700000007500} {
+		job := sidekiqJob{EnqueuedAt: enqueuedAt}
+		if got := job.latency(now); got != 2500*time.Millisecond {
+			t.Fatalf("latency for %v: got %s", enqueuedAt, got)
+		}
+	}
+	if got := (&sidekiqJob{}).latency(now); got != 0 {
+		t.Fatalf("expected zero latency without enqueued_at, got %s", got)
+	}
+}
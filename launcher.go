@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout matches Sidekiq's default -t of 25 seconds.
+const defaultShutdownTimeout = 25 * time.Second
+
+// lifecycle is the shared run state of a service process. Quiet stops
+// fetching new jobs; stop also ends the heartbeat so the process can exit;
+// kill cancels the jobs still running once the shutdown timeout has passed.
+type lifecycle struct {
+	quietOnce sync.Once
+	stopOnce  sync.Once
+	quietCh   chan struct{}
+	stopCh    chan struct{}
+	// jobs is the context every job's context derives from.
+	jobs context.Context
+	kill context.CancelFunc
+}
+
+func newLifecycle() *lifecycle {
+	jobs, kill := context.WithCancel(context.Background())
+	return &lifecycle{quietCh: make(chan struct{}), stopCh: make(chan struct{}), jobs: jobs, kill: kill}
+}
+
+func (l *lifecycle) quiet() {
+	l.quietOnce.Do(func() { close(l.quietCh) })
+}
+
+func (l *lifecycle) stop() {
+	l.quiet()
+	l.stopOnce.Do(func() { close(l.stopCh) })
+}
+
+// killed reports whether running jobs have been cancelled by a shutdown.
+func (l *lifecycle) killed() bool {
+	return l.jobs.Err() != nil
+}
+
+func (l *lifecycle) isQuiet() bool {
+	select {
+	case <-l.quietCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d and reports false if the service started stopping in
+// the meantime.
+func (l *lifecycle) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-l.stopCh:
+		return false
+	}
+}
+
+// pause waits for d and reports false if the service went quiet in the
+// meantime.
+func (l *lifecycle) pause(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-l.quietCh:
+		return false
+	}
+}
+
+// drain waits up to timeout for the processors to finish. Jobs still
+// running after that are cancelled and pushed back onto their queues, like
+// Sidekiq's hard shutdown. It reports whether the processors finished in
+// time.
+func drain(processors *sync.WaitGroup, timeout time.Duration, life *lifecycle, client *redisClient, fetch fetcher, running *workState) bool {
+	finished := make(chan struct{})
+	go func() {
+		processors.Wait()
+		close(finished)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-finished:
+		return true
+	case <-t.C:
+	}
+	works := running.inProgress()
+	log.Printf("[go_worker] shutdown timeout passed, cancelling %d jobs", len(works))
+	life.kill()
+	requeueInProgress(client, fetch, works)
+	return false
+}
+
+// requeueInProgress pushes jobs that did not finish within the shutdown
+// timeout back onto their queues so another process picks them up.
+func requeueInProgress(client *redisClient, fetch fetcher, works []*unitOfWork) {
+	if len(works) == 0 {
+		return
+	}
+	err := client.withConn(func(rw *bufio.ReadWriter) error {
+		return fetch.requeue(rw, works)
+	})
+	if err != nil {
+		log.Printf("[go_worker] could not requeue %d in-flight jobs: %v", len(works), err)
+		return
+	}
+	log.Printf("[go_worker] requeued %d in-flight jobs", len(works))
+}
+
+// clearHeartbeat removes the process from Sidekiq's process list.
+func clearHeartbeat(client *redisClient, h heartbeat) {
+	err := client.withConn(func(rw *bufio.ReadWriter) error {
+		return h.clear(rw, time.Now())
+	})
+	if err != nil {
+		log.Printf("[go_worker] could not clear heartbeat: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycleQuietThenStop(t *testing.T) {
+	l := newLifecycle()
+	if l.isQuiet() {
+		t.Fatalf("expected a fresh lifecycle to be running")
+	}
+
+	l.quiet()
+	l.quiet()
+	if !l.isQuiet() {
+		t.Fatalf("expected quiet")
+	}
+	if l.pause(time.Hour) {
+		t.Fatalf("expected pause to return early once quiet")
+	}
+	if !l.sleep(time.Millisecond) {
+		t.Fatalf("expected sleep to complete while quiet but not stopping")
+	}
+
+	l.stop()
+	if l.sleep(time.Hour) {
+		t.Fatalf("expected sleep to return early once stopping")
+	}
+}
+
+func TestLifecycleSleepCompletes(t *testing.T) {
+	if !newLifecycle().sleep(time.Millisecond) {
+		t.Fatalf("expected sleep to complete while running")
+	}
+}
+
+func TestReliableFetchRequeue(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:1\r\n:1\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+
+	work := &unitOfWork{queue: "queue:go", payload: "{}", working: "queue:go|working|h:1:aa"}
+	if err := (reliableFetch{}).requeue(rw, []*unitOfWork{work}); err != nil {
+		t.Fatalf("requeue error: %v", err)
+	}
+	cmd := out.String()
+	if !strings.Contains(cmd, "$5\r\nRPUSH\r\n$8\r\nqueue:go\r\n$2\r\n{}\r\n") || !strings.Contains(cmd, "$4\r\nLREM\r\n$23\r\nqueue:go|working|h:1:aa\r\n") {
+		t.Fatalf("unexpected commands: %q", cmd)
+	}
+}
+
+func TestDrainReturnsOnceProcessorsFinish(t *testing.T) {
+	s := &pipeServer{reply: pong}
+	c, _ := newPipeClient(1, time.Minute, s)
+	defer c.close()
+	life := newLifecycle()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond)
+	}()
+	if !drain(&wg, time.Second, life, c, basicFetch{}, newWorkState()) {
+		t.Fatalf("expected the processors to finish in time")
+	}
+	if life.killed() || len(s.seen()) != 0 {
+		t.Fatalf("expected no cancellation or requeue, saw %q", s.seen())
+	}
+}
+
+func TestDrainCancelsAndRequeuesAfterTimeout(t *testing.T) {
+	s := &pipeServer{reply: pong}
+	c, _ := newPipeClient(1, time.Minute, s)
+	defer c.close()
+	life := newLifecycle()
+	running := newWorkState()
+	running.start("t1", &unitOfWork{queue: "queue:go", payload: "{}"}, time.Now())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-life.jobs.Done()
+	}()
+	if drain(&wg, 10*time.Millisecond, life, c, basicFetch{}, running) {
+		t.Fatalf("expected the shutdown timeout to pass")
+	}
+	if !life.killed() {
+		t.Fatalf("expected running jobs to be cancelled")
+	}
+	if got := s.seen(); len(got) != 1 || got[0] != "RPUSH" {
+		t.Fatalf("expected the running job to be requeued, saw %q", got)
+	}
+	wg.Wait()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "database/sql"
     "flag"
     "fmt"
@@ -17,10 +18,26 @@ func main() {
 
     var testRunID int64
     var service bool
+    var opts serviceOptions
     flag.Int64Var(&testRunID, "test-run-id", 0, "ID of test_runs row to attach results to (omit to run service)")
     flag.BoolVar(&service, "service", false, "Run as background service listening to Sidekiq queue")
+    flag.IntVar(&opts.Concurrency, "concurrency", 0, "Number of jobs processed in parallel (default WORKER_CONCURRENCY or 1)")
+    flag.BoolVar(&opts.SerialMeasurement, "serial-measurement", false, "Process one test run at a time even with concurrency > 1, for accurate memory readings")
     flag.Parse()
 
+    if flag.Arg(0) == "enqueue" {
+        if err := runEnqueueCommand(flag.Args()[1:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+    if flag.Arg(0) == "quarantine" {
+        if err := runQuarantineCommand(flag.Args()[1:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
     dsn, err := buildDSNFromEnv()
     if err != nil {
         log.Fatalf("database config error: %v", err)
@@ -35,7 +52,7 @@ func main() {
     }
 
     if service || (testRunID == 0 && flag.NArg() == 0) {
-        runService(db)
+        runService(db, opts)
         return
     }
 
@@ -52,7 +69,7 @@ func main() {
         log.Fatal("missing --test-run-id <id> argument or --service")
     }
 
-    if err := processTestRun(db, testRunID); err != nil {
+    if err := processTestRun(context.Background(), db, testRunID); err != nil {
         log.Fatal(err)
     }
 }
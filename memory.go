@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"os"
 	"os/exec"
 	"runtime"
@@ -15,6 +16,31 @@ const samplingInterval = 10 * time.Millisecond
 
 var rssBytesFunc = rssBytes
 
+// RSS is process-wide, so with several processors the peak seen by one job
+// includes whatever the others allocate, their sample loads included. When
+// serializeMeasurements is set, each measured job holds measureSlot from its
+// first query to its insert, so only one job touches the database or the
+// heap at a time.
+var (
+	serializeMeasurements bool
+	measureSlot           = make(chan struct{}, 1)
+)
+
+// acquireMeasurement waits until no other measured job is running, or
+// returns ctx's error if the job is cancelled first. It is a no-op unless
+// serial measurement is on.
+func acquireMeasurement(ctx context.Context) (func(), error) {
+	if !serializeMeasurements {
+		return func() {}, nil
+	}
+	select {
+	case measureSlot <- struct{}{}:
+		return func() { <-measureSlot }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func measurePeakResidentMemory(fn func() (Stats, float64)) (Stats, float64, float64) {
 	baseline := rssBytesFunc()
 	peak := baseline
@@ -38,9 +64,15 @@ func measurePeakResidentMemory(fn func() (Stats, float64)) (Stats, float64, floa
 		}
 	}()
 
-	stats, duration := fn()
-	close(stop)
-	wg.Wait()
+	// Stop the sampler even if fn panics, so a recovered job does not leave
+	// it running.
+	stats, duration := func() (Stats, float64) {
+		defer func() {
+			close(stop)
+			wg.Wait()
+		}()
+		return fn()
+	}()
 
 	if peak == 0 {
 		peak = baseline
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -50,3 +52,89 @@ func TestMeasurePeakResidentMemoryHandlesZeroBaseline(t *testing.T) {
 		t.Fatalf("expected peak 0, got %v", peak)
 	}
 }
+
+func TestAcquireMeasurementSerializes(t *testing.T) {
+	serializeMeasurements = true
+	t.Cleanup(func() { serializeMeasurements = false })
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := acquireMeasurement(context.Background())
+			if err != nil {
+				t.Errorf("acquireMeasurement error: %v", err)
+				return
+			}
+			defer release()
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxActive != 1 {
+		t.Fatalf("expected measured jobs to run one at a time, saw %d at once", maxActive)
+	}
+}
+
+func TestAcquireMeasurementGivesUpWhenCancelled(t *testing.T) {
+	serializeMeasurements = true
+	t.Cleanup(func() { serializeMeasurements = false })
+
+	release, err := acquireMeasurement(context.Background())
+	if err != nil {
+		t.Fatalf("acquireMeasurement error: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := acquireMeasurement(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to end with the job's deadline, got %v", err)
+	}
+}
+
+func TestAcquireMeasurementParallelByDefault(t *testing.T) {
+	first, _ := acquireMeasurement(context.Background())
+	defer first()
+	done := make(chan struct{})
+	go func() {
+		release, _ := acquireMeasurement(context.Background())
+		release()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected no waiting without serial measurement")
+	}
+}
+
+func TestMeasurePeakResidentMemoryStopsSamplerOnPanic(t *testing.T) {
+	rssBytesFunc = func() float64 { return 100 }
+	t.Cleanup(func() { rssBytesFunc = rssBytes })
+
+	before := runtime.NumGoroutine()
+	err := callRecovered(func() error {
+		measurePeakResidentMemory(func() (Stats, float64) { panic("bad data") })
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected the panic to propagate")
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("sampler goroutine leaked: %d -> %d", before, after)
+	}
+}
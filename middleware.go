@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverMiddleware wraps one job invocation, like a Sidekiq server
+// middleware's call(worker, job, queue). It runs code around next, may pass
+// on a different context, and may skip next entirely to drop the job. job is
+// the payload the handler sees (the unwrapped one for ActiveJob).
+type serverMiddleware func(ctx context.Context, job *sidekiqJob, queue string, next jobHandler) error
+
+type middlewareEntry struct {
+	name string
+	fn   serverMiddleware
+}
+
+// middlewareChain is the ordered list of server middleware; the first entry
+// is the outermost and sees the job first.
+type middlewareChain struct {
+	mu      sync.RWMutex
+	entries []middlewareEntry
+}
+
+func newMiddlewareChain() *middlewareChain {
+	return &middlewareChain{}
+}
+
+// add appends a middleware, replacing one already registered under name in
+// place.
+func (c *middlewareChain) add(name string, fn serverMiddleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := c.index(name); i >= 0 {
+		c.entries[i].fn = fn
+		return
+	}
+	c.entries = append(c.entries, middlewareEntry{name: name, fn: fn})
+}
+
+// insertBefore registers a middleware so it runs just outside the existing
+// entry before.
+func (c *middlewareChain) insertBefore(before, name string, fn serverMiddleware) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.index(before)
+	if i < 0 {
+		return fmt.Errorf("no middleware named %q", before)
+	}
+	c.removeLocked(name)
+	i = c.index(before)
+	c.entries = append(c.entries[:i], append([]middlewareEntry{{name: name, fn: fn}}, c.entries[i:]...)...)
+	return nil
+}
+
+// remove drops the middleware registered under name, if any.
+func (c *middlewareChain) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(name)
+}
+
+func (c *middlewareChain) removeLocked(name string) {
+	if i := c.index(name); i >= 0 {
+		c.entries = append(c.entries[:i], c.entries[i+1:]...)
+	}
+}
+
+func (c *middlewareChain) index(name string) int {
+	for i, e := range c.entries {
+		if e.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// names lists the middleware in the order they run.
+func (c *middlewareChain) names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]string, 0, len(c.entries))
+	for _, e := range c.entries {
+		out = append(out, e.name)
+	}
+	return out
+}
+
+// invoke runs handler for job through every middleware in order. A nil
+// chain runs the handler directly.
+func (c *middlewareChain) invoke(ctx context.Context, job *sidekiqJob, queue string, handler jobHandler) error {
+	if c == nil {
+		return handler(ctx, job)
+	}
+	c.mu.RLock()
+	entries := append([]middlewareEntry(nil), c.entries...)
+	c.mu.RUnlock()
+
+	next := handler
+	for i := len(entries) - 1; i >= 0; i-- {
+		fn, inner := entries[i].fn, next
+		next = func(ctx context.Context, job *sidekiqJob) error {
+			return fn(ctx, job, queue, inner)
+		}
+	}
+	return next(ctx, job)
+}
+
+// defaultMiddleware is the order built-in middleware run in when
+// WORKER_MIDDLEWARE is not set.
+var defaultMiddleware = []string{"unique", "logging", "metrics"}
+
+// builtinMiddleware returns the built-in middleware by name.
+func builtinMiddleware(counters *jobCounters, unique uniqueConfig) map[string]serverMiddleware {
+	return map[string]serverMiddleware{
+		"unique":  uniqueMiddleware(unique),
+		"logging": loggingMiddleware,
+		"metrics": metricsMiddleware(counters),
+	}
+}
+
+// parseMiddleware builds a chain from a comma-separated list of built-in
+// middleware names, outermost first; an empty spec selects the defaults.
+func parseMiddleware(spec string, builtins map[string]serverMiddleware) (*middlewareChain, error) {
+	names := defaultMiddleware
+	if strings.TrimSpace(spec) != "" {
+		names = nil
+		for _, name := range strings.Split(spec, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	chain := newMiddlewareChain()
+	for _, name := range names {
+		fn, ok := builtins[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if chain.index(name) >= 0 {
+			return nil, fmt.Errorf("middleware %q listed twice", name)
+		}
+		chain.add(name, fn)
+	}
+	return chain, nil
+}
+
+type tidKey struct{}
+
+// withTID records the id of the processor running a job, for middleware
+// that log it.
+func withTID(ctx context.Context, tid string) context.Context {
+	return context.WithValue(ctx, tidKey{}, tid)
+}
+
+func tidFrom(ctx context.Context) string {
+	tid, _ := ctx.Value(tidKey{}).(string)
+	return tid
+}
+
+type jidKey struct{}
+
+// withJID records the jid of the running job, so handlers can put it on
+// their own log lines and results.
+func withJID(ctx context.Context, jid string) context.Context {
+	return context.WithValue(ctx, jidKey{}, jid)
+}
+
+func jidFrom(ctx context.Context) string {
+	jid, _ := ctx.Value(jidKey{}).(string)
+	return jid
+}
+
+// loggingMiddleware logs the start and end of every job with its jid, how
+// long it waited in the queue and how long it ran.
+func loggingMiddleware(ctx context.Context, job *sidekiqJob, queue string, next jobHandler) error {
+	started := time.Now()
+	latency := job.latency(started)
+	log.Printf("[go_worker] start key=%s class=%s jid=%s args=%s latency=%.3fs tid=%s", queue, job.Class, job.JID, formatArgs(job.Args), latency.Seconds(), tidFrom(ctx))
+	err := next(ctx, job)
+	elapsed := time.Since(started)
+	if err != nil {
+		log.Printf("[go_worker] fail class=%s jid=%s latency=%.3fs elapsed=%.3fs err=%v tid=%s", job.Class, job.JID, latency.Seconds(), elapsed.Seconds(), err, tidFrom(ctx))
+	} else {
+		log.Printf("[go_worker] done class=%s jid=%s latency=%.3fs elapsed=%.3fs tid=%s", job.Class, job.JID, latency.Seconds(), elapsed.Seconds(), tidFrom(ctx))
+	}
+	return err
+}
+
+// metricsMiddleware counts processed and failed jobs for the Web UI
+// dashboard. Jobs rejected for bad arguments or skipped as duplicates are not
+// counted.
+func metricsMiddleware(counters *jobCounters) serverMiddleware {
+	return func(ctx context.Context, job *sidekiqJob, queue string, next jobHandler) error {
+		err := next(ctx, job)
+		if !errors.Is(err, errBadArgs) && !errors.Is(err, errDuplicateJob) {
+			counters.record(err != nil)
+		}
+		return err
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func tracingMiddleware(name string, trace *[]string) serverMiddleware {
+	return func(ctx context.Context, job *sidekiqJob, queue string, next jobHandler) error {
+		*trace = append(*trace, name+">")
+		err := next(ctx, job)
+		*trace = append(*trace, "<"+name)
+		return err
+	}
+}
+
+func TestMiddlewareChainOrder(t *testing.T) {
+	var trace []string
+	chain := newMiddlewareChain()
+	chain.add("a", tracingMiddleware("a", &trace))
+	chain.add("c", tracingMiddleware("c", &trace))
+	if err := chain.insertBefore("c", "b", tracingMiddleware("b", &trace)); err != nil {
+		t.Fatalf("insertBefore error: %v", err)
+	}
+
+	err := chain.invoke(context.Background(), &sidekiqJob{Class: "X"}, "queue:go", func(ctx context.Context, job *sidekiqJob) error {
+		trace = append(trace, "job")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("invoke error: %v", err)
+	}
+	want := []string{"a>", "b>", "c>", "job", "<c", "<b", "<a"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("unexpected order: %v", trace)
+	}
+
+	chain.remove("b")
+	if got := chain.names(); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Fatalf("unexpected names after remove: %v", got)
+	}
+	if err := chain.insertBefore("missing", "d", tracingMiddleware("d", &trace)); err == nil {
+		t.Fatalf("expected error inserting before a missing middleware")
+	}
+}
+
+func TestMiddlewareCanSkipJob(t *testing.T) {
+	chain := newMiddlewareChain()
+	chain.add("skip", func(ctx context.Context, job *sidekiqJob, queue string, next jobHandler) error {
+		return nil
+	})
+	ran := false
+	_ = chain.invoke(context.Background(), &sidekiqJob{}, "queue:go", func(ctx context.Context, job *sidekiqJob) error {
+		ran = true
+		return nil
+	})
+	if ran {
+		t.Fatalf("expected handler to be skipped")
+	}
+}
+
+func TestParseMiddleware(t *testing.T) {
+	builtins := builtinMiddleware(&jobCounters{}, uniqueConfig{})
+	chain, err := parseMiddleware("", builtins)
+	if err != nil || !reflect.DeepEqual(chain.names(), defaultMiddleware) {
+		t.Fatalf("expected defaults, got %v %v", chain, err)
+	}
+	chain, err = parseMiddleware(" metrics ", builtins)
+	if err != nil || !reflect.DeepEqual(chain.names(), []string{"metrics"}) {
+		t.Fatalf("unexpected chain: %v %v", chain, err)
+	}
+	for _, spec := range []string{"logging,nope", "metrics,metrics"} {
+		if _, err := parseMiddleware(spec, builtins); err == nil {
+			t.Fatalf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestMetricsMiddlewareSkipsBadArgs(t *testing.T) {
+	counters := &jobCounters{}
+	m := metricsMiddleware(counters)
+	for _, jobErr := range []error{nil, errors.New("boom"), fmt.Errorf("%w: no id", errBadArgs)} {
+		_ = m(context.Background(), &sidekiqJob{}, "queue:go", func(ctx context.Context, job *sidekiqJob) error {
+			return jobErr
+		})
+	}
+	if processed, failed := counters.take(); processed != 2 || failed != 1 {
+		t.Fatalf("unexpected counters: %d %d", processed, failed)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCallRecoveredTurnsPanicIntoError(t *testing.T) {
+	err := callRecovered(func() error { panic("bad sample") })
+	var perr *panicError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected panicError, got %v", err)
+	}
+	if err.Error() != "panic: bad sample" || errorClass(err) != "main.panicError" {
+		t.Fatalf("unexpected error: %v (%s)", err, errorClass(err))
+	}
+	if !strings.Contains(string(perr.stack), "TestCallRecoveredTurnsPanicIntoError") {
+		t.Fatalf("expected stack to include the panicking function:\n%s", perr.stack)
+	}
+}
+
+func TestCallRecoveredUnwrapsRuntimeErrors(t *testing.T) {
+	err := callRecovered(func() error {
+		var values []float64
+		_ = values[3]
+		return nil
+	})
+	var rerr runtime.Error
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected runtime.Error, got %v", err)
+	}
+	if errorClass(err) != "runtime.boundsError" {
+		t.Fatalf("unexpected error class %s", errorClass(err))
+	}
+}
+
+func TestCallRecoveredPassesErrorsThrough(t *testing.T) {
+	want := errors.New("boom")
+	if err := callRecovered(func() error { return want }); err != want {
+		t.Fatalf("expected the returned error, got %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// processor is one fetch-and-run loop with its own Redis connection. A
+// service runs WORKER_CONCURRENCY of them sharing the *sql.DB.
+type processor struct {
+	registry *registry
+	unknown  unknownClassPolicy
+	fallback string
+	// quarantineKey is the list unprocessable payloads are moved to.
+	quarantineKey string
+	client        *redisClient
+	fetch         fetcher
+	queues        queueList
+	running       *workState
+	// middleware wraps every handler call; nil runs handlers bare.
+	middleware *middlewareChain
+	timeouts   jobTimeouts
+	unique     uniqueConfig
+	life       *lifecycle
+	tid        string
+	// bounces counts consecutive jobs handed back for lack of a handler.
+	bounces int
+}
+
+// run fetches and processes jobs until the service goes quiet.
+func (p *processor) run() {
+	for !p.life.isQuiet() {
+		conn, rw, err := p.client.dialBlocking()
+		if err != nil {
+			log.Printf("%v; retrying in 2s", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		log.Printf("[go_worker] connected redis_host=%s db=%d listening=%s tid=%s", p.client.cfg.Host, p.client.cfg.DB, strings.Join(p.queues.keys(), ","), p.tid)
+		lastHeartbeat := time.Now()
+
+		for !p.life.isQuiet() {
+			work, err := p.fetch.retrieveWork(rw)
+			if err != nil {
+				if err != ioEOF {
+					log.Printf("redis read error: %v", err)
+				}
+				break
+			}
+			if work == nil {
+				if time.Since(lastHeartbeat) >= 60*time.Second {
+					log.Printf("[go_worker] idle (no jobs) queues=%s tid=%s", p.queues, p.tid)
+					lastHeartbeat = time.Now()
+				}
+				continue // timeout
+			}
+			lastHeartbeat = time.Now()
+			if p.life.isQuiet() {
+				// Fetched while a blocking pop was in flight; hand it back.
+				if err := p.fetch.requeue(rw, []*unitOfWork{work}); err != nil {
+					log.Printf("redis requeue error: %v", err)
+				}
+				break
+			}
+			if err := p.process(rw, work); err != nil {
+				log.Printf("redis error: %v", err)
+				break
+			}
+		}
+		conn.Close()
+		if !p.life.isQuiet() {
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+
+// process runs one fetched job and acknowledges it. Only Redis errors are
+// returned; job failures go to the retry and dead sets. A job whose
+// bookkeeping fails is left unacknowledged, so with reliable fetch it stays
+// in the working list and is recovered once this process is gone.
+func (p *processor) process(rw *bufio.ReadWriter, work *unitOfWork) error {
+	key, payload := work.queue, work.payload
+	var job sidekiqJob
+	if err := json.Unmarshal([]byte(payload), &job); err != nil {
+		return p.quarantine(rw, work, "", fmt.Sprintf("invalid job json: %v", err))
+	}
+	// ActiveJob payloads run under their wrapped class; the retry and dead
+	// sets still get the original wrapper payload.
+	run, err := unwrapActiveJob(&job)
+	if err != nil {
+		return p.quarantine(rw, work, job.JID, fmt.Sprintf("invalid activejob payload: %v", err))
+	}
+	if run.Class == "" {
+		// Not an unknown class: no worker anywhere can run it, so requeueing
+		// would bounce it forever.
+		return p.quarantine(rw, work, job.JID, "missing class")
+	}
+	handler, ok := p.registry.lookup(run.Class)
+	if !ok {
+		return p.handleUnknownClass(rw, work, &job)
+	}
+	p.bounces = 0
+
+	p.running.start(p.tid, work, time.Now())
+	err = p.execute(withRedis(withJID(withTID(p.life.jobs, p.tid), run.JID), rw), run, key, handler)
+	p.running.finish(p.tid)
+	if err != nil && p.life.killed() {
+		// The shutdown requeued the job; retrying or acknowledging it too
+		// would run it twice or lose it.
+		log.Printf("[go_worker] job cancelled by shutdown, left for requeue class=%s jid=%s", run.Class, job.JID)
+		return nil
+	}
+	if errors.Is(err, errBadArgs) {
+		return p.quarantine(rw, work, job.JID, fmt.Sprintf("%s: %v", run.Class, err))
+	}
+	if errors.Is(err, errDuplicateJob) {
+		log.Printf("[go_worker] skipping duplicate job class=%s jid=%s: %v", run.Class, job.JID, err)
+		return p.fetch.acknowledge(rw, work)
+	}
+	if err != nil {
+		outcome, rerr := handleJobFailure(rw, &job, err, time.Now())
+		if rerr != nil {
+			return fmt.Errorf("retry bookkeeping failed: %w", rerr)
+		}
+		switch outcome {
+		case failureRetried:
+			log.Printf("[go_worker] scheduled retry class=%s jid=%s", run.Class, job.JID)
+		case failureDead:
+			log.Printf("[go_worker] retries exhausted, moved to dead set class=%s jid=%s", run.Class, job.JID)
+		case failureExhausted:
+			log.Printf("[go_worker] retries exhausted, discarded class=%s jid=%s", run.Class, job.JID)
+		}
+		if outcome != failureRetried {
+			if err := p.unique.releaseAfterFailure(rw, run); err != nil {
+				log.Printf("[go_worker] could not release unique lock class=%s jid=%s: %v", run.Class, job.JID, err)
+			}
+		}
+	}
+	return p.fetch.acknowledge(rw, work)
+}
+
+// quarantine moves a payload that can never be processed to the quarantine
+// list instead of retrying it.
+func (p *processor) quarantine(rw *bufio.ReadWriter, work *unitOfWork, jid, reason string) error {
+	if p.quarantineKey == "" {
+		return fmt.Errorf("cannot quarantine payload from %s jid=%s (%s): no quarantine list configured", work.queue, jid, reason)
+	}
+	log.Printf("[go_worker] quarantining payload from %s jid=%s list=%s: %s", work.queue, jid, p.quarantineKey, reason)
+	return quarantine(rw, p.quarantineKey, work, reason, time.Now())
+}
+
+// execute runs the handler through the middleware chain. A panic in the
+// handler is recovered before it reaches the middleware, so logging and
+// metrics see it as a failed job; a panic in middleware is recovered too.
+// Either way it fails the job instead of the process. With a timeout for the
+// job's class the context is cancelled once it passes, and a job that then
+// fails is reported with a *jobTimeoutError.
+func (p *processor) execute(ctx context.Context, job *sidekiqJob, queue string, handler jobHandler) error {
+	limit := p.timeouts.forClass(job.Class)
+	if limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+	recovered := func(ctx context.Context, job *sidekiqJob) error {
+		err := callRecovered(func() error { return handler(ctx, job) })
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = &jobTimeoutError{class: job.Class, timeout: limit, err: err}
+		}
+		return err
+	}
+	err := callRecovered(func() error { return p.middleware.invoke(ctx, job, queue, recovered) })
+	var perr *panicError
+	if errors.As(err, &perr) {
+		log.Printf("[go_worker] recovered %v class=%s jid=%s tid=%s\n%s", perr, job.Class, job.JID, p.tid, perr.stack)
+	}
+	return err
+}
+
+func (p *processor) handleUnknownClass(rw *bufio.ReadWriter, work *unitOfWork, job *sidekiqJob) error {
+	class := job.displayClass()
+	switch p.unknown {
+	case unknownClassRequeue:
+		if err := reenqueue(rw, work); err != nil {
+			return err
+		}
+		p.bounces++
+		wait := bounceBackoff(p.bounces)
+		log.Printf("[go_worker] no handler for class=%s jid=%s, returned it to %s; pausing %s", class, job.JID, work.queue, wait)
+		p.life.pause(wait)
+		return nil
+	case unknownClassForward:
+		p.bounces = 0
+		log.Printf("[go_worker] no handler for class=%s jid=%s, forwarding it to queue:%s", class, job.JID, p.fallback)
+		return forward(rw, work, job, p.fallback)
+	case unknownClassDead:
+		p.bounces = 0
+		log.Printf("[go_worker] no handler for class=%s jid=%s, moving it to the dead set", class, job.JID)
+		recordFailure(job, unknownClassError{class: class}, time.Now())
+		if err := killJob(rw, job, time.Now()); err != nil {
+			return err
+		}
+		return p.fetch.acknowledge(rw, work)
+	default:
+		p.bounces = 0
+		log.Printf("skipping job class=%s jid=%s", class, job.JID)
+		return p.fetch.acknowledge(rw, work)
+	}
+}
+
+func formatArgs(args []json.RawMessage) string {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return "?"
+	}
+	return string(b)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingFetch struct {
+	acked    []string
+	requeued []string
+}
+
+func (f *recordingFetch) retrieveWork(rw *bufio.ReadWriter) (*unitOfWork, error) {
+	return nil, nil
+}
+
+func (f *recordingFetch) acknowledge(rw *bufio.ReadWriter, work *unitOfWork) error {
+	f.acked = append(f.acked, work.payload)
+	return nil
+}
+
+func (f *recordingFetch) requeue(rw *bufio.ReadWriter, works []*unitOfWork) error {
+	for _, work := range works {
+		f.requeued = append(f.requeued, work.payload)
+	}
+	return nil
+}
+
+func TestProcessorQuarantinesUnprocessableJobs(t *testing.T) {
+	for payload, reason := range map[string]string{
+		`not json`:                         "invalid job json",
+		`{"class":"RubyWorker","args":[]}`: "RubyWorker: invalid job arguments: missing test_run_id",
+		`{"class":"Sidekiq::ActiveJob::Wrapper","args":[]}`: "invalid activejob payload",
+		`{"args":[1],"jid":"abc"}`:                          "missing class",
+	} {
+		rw, out := fakeRedis("+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n:1\r\n+OK\r\n:1\r\n")
+		f := &recordingFetch{}
+		jobs := newRegistry()
+		jobs.register("RubyWorker", testRunJob(nil, false))
+		counters := &jobCounters{}
+		chain := newMiddlewareChain()
+		chain.add("metrics", metricsMiddleware(counters))
+		p := &processor{registry: jobs, quarantineKey: "poison", fetch: f, running: newWorkState(), middleware: chain, life: newLifecycle(), tid: "t1"}
+		work := &unitOfWork{queue: "queue:go", payload: payload, working: "queue:go|working|me"}
+		if err := p.process(rw, work); err != nil {
+			t.Fatalf("process(%s) error: %v", payload, err)
+		}
+		cmd := out.String()
+		if !strings.Contains(cmd, "$5\r\nLPUSH\r\n$6\r\npoison\r\n") || !strings.Contains(cmd, reason) {
+			t.Fatalf("expected %s to be quarantined with %q: %q", payload, reason, cmd)
+		}
+		if !strings.Contains(cmd, "$4\r\nLREM\r\n$19\r\nqueue:go|working|me\r\n") {
+			t.Fatalf("expected %s to leave its working list: %q", payload, cmd)
+		}
+		if processed, _ := counters.take(); processed != 0 {
+			t.Fatalf("expected %s not to count as processed", payload)
+		}
+	}
+}
+
+func TestProcessorRefusesEmptyQuarantineKey(t *testing.T) {
+	rw, out := fakeRedis("")
+	f := &recordingFetch{}
+	p := &processor{registry: newRegistry(), fetch: f, running: newWorkState(), life: newLifecycle(), tid: "t1"}
+	err := p.process(rw, &unitOfWork{queue: "queue:go", payload: `not json`})
+	if err == nil || !strings.Contains(err.Error(), "no quarantine list configured") {
+		t.Fatalf("expected an error without a quarantine list, got %v", err)
+	}
+	if out.Len() != 0 || len(f.acked) != 0 {
+		t.Fatalf("expected nothing written and no ack: %q", out.String())
+	}
+}
+
+func TestProcessorDropsUnknownClassWithDropPolicy(t *testing.T) {
+	f := &recordingFetch{}
+	p := &processor{registry: newRegistry(), unknown: unknownClassDrop, fetch: f, running: newWorkState(), life: newLifecycle(), tid: "t1"}
+	if err := p.process(nil, &unitOfWork{queue: "queue:go", payload: `{"class":"OtherWorker","args":[1]}`}); err != nil {
+		t.Fatalf("process error: %v", err)
+	}
+	if len(f.acked) != 1 {
+		t.Fatalf("expected job to be acknowledged")
+	}
+}
+
+func TestProcessorRunsRegisteredHandler(t *testing.T) {
+	var got []json.RawMessage
+	var jid, tid string
+	jobs := newRegistry()
+	jobs.register("BenchWorker", func(ctx context.Context, job *sidekiqJob) error {
+		got = job.Args
+		jid, tid = jidFrom(ctx), tidFrom(ctx)
+		return nil
+	})
+	f := &recordingFetch{}
+	counters := &jobCounters{}
+	chain, err := parseMiddleware("", builtinMiddleware(counters, uniqueConfig{}))
+	if err != nil {
+		t.Fatalf("parseMiddleware error: %v", err)
+	}
+	p := &processor{registry: jobs, fetch: f, running: newWorkState(), middleware: chain, life: newLifecycle(), tid: "t1"}
+
+	if err := p.process(nil, &unitOfWork{queue: "queue:go", payload: `{"class":"BenchWorker","args":[1,"x"],"jid":"j1"}`}); err != nil {
+		t.Fatalf("process error: %v", err)
+	}
+	if len(got) != 2 || len(f.acked) != 1 {
+		t.Fatalf("expected handler to run and job to be acknowledged: %v %v", got, f.acked)
+	}
+	if jid != "j1" || tid != "t1" {
+		t.Fatalf("expected the handler context to carry jid and tid, got %q %q", jid, tid)
+	}
+	if processed, failed := counters.take(); processed != 1 || failed != 0 {
+		t.Fatalf("unexpected counters: %d %d", processed, failed)
+	}
+}
+
+func TestProcessorRequeuesUnknownClass(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:1\r\n:1\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+
+	f := &recordingFetch{}
+	p := &processor{registry: newRegistry(), unknown: unknownClassRequeue, fetch: f, running: newWorkState(), life: newLifecycle(), tid: "t1"}
+	work := &unitOfWork{queue: "queue:default", payload: `{"class":"MailerWorker","args":[]}`, working: "queue:default|working|h:1:aa"}
+	if err := p.process(rw, work); err != nil {
+		t.Fatalf("process error: %v", err)
+	}
+	cmd := out.String()
+	if !strings.Contains(cmd, "$5\r\nLPUSH\r\n$13\r\nqueue:default\r\n") || !strings.Contains(cmd, "$4\r\nLREM\r\n") {
+		t.Fatalf("expected LPUSH and LREM in a transaction: %q", cmd)
+	}
+	if len(f.acked) != 0 {
+		t.Fatalf("requeued job must not be acknowledged separately")
+	}
+	if p.bounces != 1 {
+		t.Fatalf("expected one bounce, got %d", p.bounces)
+	}
+}
+
+func TestProcessorForwardsUnknownClassToFallbackQueue(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n:0\r\n:1\r\n:1\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+
+	p := &processor{registry: newRegistry(), unknown: unknownClassForward, fallback: "ruby", fetch: &recordingFetch{}, running: newWorkState(), life: newLifecycle(), tid: "t1"}
+	work := &unitOfWork{queue: "queue:default", payload: `{"class":"MailerWorker","args":[],"queue":"default"}`, working: "queue:default|working|h:1:aa"}
+	if err := p.process(rw, work); err != nil {
+		t.Fatalf("process error: %v", err)
+	}
+	cmd := out.String()
+	for _, want := range []string{
+		"$4\r\nSADD\r\n$6\r\nqueues\r\n$4\r\nruby\r\n",
+		"$5\r\nLPUSH\r\n$10\r\nqueue:ruby\r\n",
+		`"queue":"ruby"`,
+		"$4\r\nLREM\r\n$28\r\nqueue:default|working|h:1:aa\r\n",
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Fatalf("expected %q in %q", want, cmd)
+		}
+	}
+}
+
+func TestProcessorSendsUnknownClassToDeadSet(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n:1\r\n:0\r\n:0\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+
+	f := &recordingFetch{}
+	p := &processor{registry: newRegistry(), unknown: unknownClassDead, fetch: f, running: newWorkState(), life: newLifecycle(), tid: "t1"}
+	if err := p.process(rw, &unitOfWork{queue: "queue:default", payload: `{"class":"MailerWorker","args":[]}`}); err != nil {
+		t.Fatalf("process error: %v", err)
+	}
+	if !strings.Contains(out.String(), "no handler registered for job class MailerWorker") {
+		t.Fatalf("expected error message in dead payload: %q", out.String())
+	}
+	if len(f.acked) != 1 {
+		t.Fatalf("expected job to be acknowledged after moving to the dead set")
+	}
+}
+
+func TestProcessorRunsActiveJobUnderWrappedClass(t *testing.T) {
+	var got *sidekiqJob
+	jobs := newRegistry()
+	jobs.register("ReportJob", func(ctx context.Context, job *sidekiqJob) error {
+		got = job
+		return nil
+	})
+	f := &recordingFetch{}
+	p := &processor{registry: jobs, fetch: f, running: newWorkState(), life: newLifecycle(), tid: "t1"}
+
+	if err := p.process(nil, &unitOfWork{queue: "queue:default", payload: activeJobPayloadJSON}); err != nil {
+		t.Fatalf("process error: %v", err)
+	}
+	if got == nil || got.Class != "ReportJob" || len(got.Args) != 4 {
+		t.Fatalf("expected ReportJob handler to run with unwrapped args: %+v", got)
+	}
+	if len(f.acked) != 1 {
+		t.Fatalf("expected job to be acknowledged")
+	}
+}
+
+func TestProcessorRetriesPanickingJob(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(":1\r\n")), bufio.NewWriter(out))
+	jobs := newRegistry()
+	jobs.register("BenchWorker", func(ctx context.Context, job *sidekiqJob) error {
+		panic("division by zero in stats")
+	})
+	counters := &jobCounters{}
+	chain, _ := parseMiddleware("", builtinMiddleware(counters, uniqueConfig{}))
+	f := &recordingFetch{}
+	running := newWorkState()
+	p := &processor{registry: jobs, fetch: f, running: running, middleware: chain, life: newLifecycle(), tid: "t1"}
+
+	if err := p.process(rw, &unitOfWork{queue: "queue:go", payload: `{"class":"BenchWorker","args":[1]}`}); err != nil {
+		t.Fatalf("process error: %v", err)
+	}
+	if cmd := out.String(); !strings.Contains(cmd, "$5\r\nretry\r\n") || !strings.Contains(cmd, `"error_class":"main.panicError"`) {
+		t.Fatalf("expected the panic to be scheduled for retry: %q", cmd)
+	}
+	if processed, failed := counters.take(); processed != 1 || failed != 1 {
+		t.Fatalf("expected metrics middleware to count the failure, got %d %d", processed, failed)
+	}
+	if len(f.acked) != 1 || len(running.inProgress()) != 0 {
+		t.Fatalf("expected job to be acknowledged and finished")
+	}
+}
+
+func TestProcessorReleasesUniqueLockWhenFailureIsFinal(t *testing.T) {
+	cases := []struct {
+		name        string
+		retry       string
+		replies     string
+		wantRelease bool
+	}{
+		{"retried", `3`, "+OK\r\n:1\r\n", false},
+		{"discarded", `false`, "+OK\r\n:1\r\n", true},
+		{"dead", `0`, "+OK\r\n+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n:1\r\n:0\r\n:0\r\n:1\r\n", true},
+	}
+	for _, c := range cases {
+		unique, _ := parseUniqueConfig("BenchWorker=until_executed", "")
+		jobs := newRegistry()
+		jobs.register("BenchWorker", func(ctx context.Context, job *sidekiqJob) error {
+			return errors.New("boom")
+		})
+		chain, _ := parseMiddleware("unique", builtinMiddleware(&jobCounters{}, unique))
+		f := &recordingFetch{}
+		p := &processor{registry: jobs, fetch: f, running: newWorkState(), middleware: chain, unique: unique, life: newLifecycle(), tid: "t1"}
+		rw, out := fakeRedis(c.replies)
+
+		payload := `{"class":"BenchWorker","args":[1],"jid":"mine","retry":` + c.retry + `}`
+		if err := p.process(rw, &unitOfWork{queue: "queue:go", payload: payload}); err != nil {
+			t.Fatalf("%s: process error: %v", c.name, err)
+		}
+		if got := strings.Contains(out.String(), "EVALSHA"); got != c.wantRelease {
+			t.Fatalf("%s: lock released=%t, want %t: %q", c.name, got, c.wantRelease, out.String())
+		}
+		if len(f.acked) != 1 {
+			t.Fatalf("%s: expected job to be acknowledged", c.name)
+		}
+	}
+}
+
+func TestProcessorTimesOutSlowJob(t *testing.T) {
+	jobs := newRegistry()
+	jobs.register("SlowWorker", func(ctx context.Context, job *sidekiqJob) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	timeouts, _ := parseJobTimeouts("60", "SlowWorker=0.01")
+	p := &processor{registry: jobs, running: newWorkState(), timeouts: timeouts, life: newLifecycle(), tid: "t1"}
+
+	handler, _ := jobs.lookup("SlowWorker")
+	err := p.execute(context.Background(), &sidekiqJob{Class: "SlowWorker"}, "queue:go", handler)
+	var terr *jobTimeoutError
+	if !errors.As(err, &terr) || terr.timeout != 10*time.Millisecond {
+		t.Fatalf("expected a jobTimeoutError, got %v", err)
+	}
+}
+
+func TestProcessorLeavesCancelledJobForRequeue(t *testing.T) {
+	life := newLifecycle()
+	jobs := newRegistry()
+	jobs.register("SlowWorker", func(ctx context.Context, job *sidekiqJob) error {
+		life.kill()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	f := &recordingFetch{}
+	p := &processor{registry: jobs, fetch: f, running: newWorkState(), life: life, tid: "t1"}
+	rw, out := fakeRedis("")
+
+	if err := p.process(rw, &unitOfWork{queue: "queue:go", payload: `{"class":"SlowWorker","args":[1]}`}); err != nil {
+		t.Fatalf("process error: %v", err)
+	}
+	if out.Len() != 0 || len(f.acked) != 0 {
+		t.Fatalf("expected no retry or acknowledgement, got %q acked=%v", out.String(), f.acked)
+	}
+}
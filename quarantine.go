@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultQuarantineKey = "go_worker:quarantine"
+	// quarantineMaxEntries caps the list like the dead set, dropping the
+	// oldest entries first.
+	quarantineMaxEntries = 10000
+)
+
+// quarantineEntry is a payload this worker could not process, kept with the
+// reason so it can be inspected and requeued once the enqueuing side is
+// fixed. Payload is the raw string exactly as it was popped.
+type quarantineEntry struct {
+	ID            string  `json:"id"`
+	Queue         string  `json:"queue"`
+	Reason        string  `json:"reason"`
+	QuarantinedAt float64 `json:"quarantined_at"`
+	Payload       string  `json:"payload"`
+}
+
+// quarantine moves a popped payload to the quarantine list, removing it from
+// its working list in the same transaction when it was fetched reliably.
+func quarantine(rw *bufio.ReadWriter, key string, work *unitOfWork, reason string, now time.Time) error {
+	entry, err := json.Marshal(quarantineEntry{
+		ID:            newJID(),
+		Queue:         work.queue,
+		Reason:        reason,
+		QuarantinedAt: epochSeconds(now),
+		Payload:       work.payload,
+	})
+	if err != nil {
+		return err
+	}
+	cmds := [][]string{
+		{"LPUSH", key, string(entry)},
+		{"LTRIM", key, "0", strconv.Itoa(quarantineMaxEntries - 1)},
+	}
+	if work.working != "" {
+		cmds = append(cmds, []string{"LREM", work.working, "-1", work.payload})
+	}
+	_, err = execMulti(rw, cmds)
+	return err
+}
+
+// quarantined returns the entries in the list, newest first, with the raw
+// list elements needed to remove them.
+func quarantined(rw *bufio.ReadWriter, key string) ([]quarantineEntry, []string, error) {
+	if err := writeCommand(rw, "LRANGE", key, "0", "-1"); err != nil {
+		return nil, nil, err
+	}
+	raw, err := readStringArray(rw)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make([]quarantineEntry, len(raw))
+	for i, r := range raw {
+		if err := json.Unmarshal([]byte(r), &entries[i]); err != nil {
+			entries[i] = quarantineEntry{Reason: "unreadable quarantine entry", Payload: r}
+		}
+	}
+	return entries, raw, nil
+}
+
+var errNoQuarantineEntry = errors.New("no such quarantine entry")
+
+func findQuarantined(rw *bufio.ReadWriter, key, id string) (quarantineEntry, string, error) {
+	entries, raw, err := quarantined(rw, key)
+	if err != nil {
+		return quarantineEntry{}, "", err
+	}
+	for i, e := range entries {
+		if e.ID == id {
+			return e, raw[i], nil
+		}
+	}
+	return quarantineEntry{}, "", fmt.Errorf("%w: %s", errNoQuarantineEntry, id)
+}
+
+// deleteQuarantined removes one entry for good.
+func deleteQuarantined(rw *bufio.ReadWriter, key, id string) error {
+	_, raw, err := findQuarantined(rw, key, id)
+	if err != nil {
+		return err
+	}
+	if err := writeCommand(rw, "LREM", key, "1", raw); err != nil {
+		return err
+	}
+	_, err = readInteger(rw)
+	return err
+}
+
+// requeueQuarantined pushes an entry's payload back onto the queue it was
+// popped from, as it was, and removes the entry.
+func requeueQuarantined(rw *bufio.ReadWriter, key, id string) (quarantineEntry, error) {
+	entry, raw, err := findQuarantined(rw, key, id)
+	if err != nil {
+		return entry, err
+	}
+	if entry.Queue == "" {
+		return entry, fmt.Errorf("quarantine entry %s has no queue", id)
+	}
+	cmds := [][]string{
+		{"SADD", "queues", strings.TrimPrefix(entry.Queue, "queue:")},
+		{"LPUSH", entry.Queue, entry.Payload},
+		{"LREM", key, "1", raw},
+	}
+	_, err = execMulti(rw, cmds)
+	return entry, err
+}
+
+// quarantineKey is WORKER_QUARANTINE_KEY or the default list.
+func quarantineKey() string {
+	if key := os.Getenv("WORKER_QUARANTINE_KEY"); key != "" {
+		return key
+	}
+	return defaultQuarantineKey
+}
+
+// runQuarantineCommand implements `go_worker quarantine list|show|delete|requeue`.
+func runQuarantineCommand(argv []string) error {
+	fs := flag.NewFlagSet("quarantine", flag.ContinueOnError)
+	key := fs.String("key", quarantineKey(), "Redis list holding quarantined payloads")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: go_worker quarantine [flags] list | show <id> | delete <id> | requeue <id>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	action := fs.Arg(0)
+	id := fs.Arg(1)
+	switch {
+	case action == "list" && fs.NArg() == 1:
+	case (action == "show" || action == "delete" || action == "requeue") && fs.NArg() == 2:
+	default:
+		fs.Usage()
+		return errors.New("invalid quarantine command")
+	}
+
+	cfg, err := redisConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	conn, rw, err := dialRedis(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch action {
+	case "list":
+		entries, _, err := quarantined(rw, *key)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Fprintf(os.Stdout, "%s  %s  %s  %s  %s\n", e.ID, epochTime(e.QuarantinedAt).UTC().Format(time.RFC3339), e.Queue, e.Reason, truncate(e.Payload, 80))
+		}
+		fmt.Fprintf(os.Stdout, "%d quarantined\n", len(entries))
+	case "show":
+		entry, _, err := findQuarantined(rw, *key, id)
+		if err != nil {
+			return err
+		}
+		out, _ := json.MarshalIndent(entry, "", "  ")
+		fmt.Fprintln(os.Stdout, string(out))
+	case "delete":
+		if err := deleteQuarantined(rw, *key, id); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "deleted %s\n", id)
+	case "requeue":
+		entry, err := requeueQuarantined(rw, *key, id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "requeued %s onto %s\n", id, entry.Queue)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuarantinePushesEntry(t *testing.T) {
+	rw, out := fakeRedis("+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:1\r\n+OK\r\n")
+	work := &unitOfWork{queue: "queue:go", payload: `{"class":`}
+	if err := quarantine(rw, "poison", work, "invalid job json", time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("quarantine error: %v", err)
+	}
+	cmd := out.String()
+	if !strings.Contains(cmd, "$5\r\nLTRIM\r\n$6\r\npoison\r\n$1\r\n0\r\n$4\r\n9999\r\n") {
+		t.Fatalf("expected list to be trimmed: %q", cmd)
+	}
+	if strings.Contains(cmd, "LREM") {
+		t.Fatalf("basic fetch has no working list to clean: %q", cmd)
+	}
+	start := strings.Index(cmd, `{"id"`)
+	end := strings.Index(cmd[start:], "\r\n")
+	var entry quarantineEntry
+	if err := json.Unmarshal([]byte(cmd[start:start+end]), &entry); err != nil {
+		t.Fatalf("entry is not JSON: %v", err)
+	}
+	if entry.Queue != "queue:go" || entry.Reason != "invalid job json" || entry.QuarantinedAt != 1700000000 || entry.Payload != `{"class":` || entry.ID == "" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+}
+
+func quarantineList(entries ...quarantineEntry) string {
+	reply := fmt.Sprintf("*%d\r\n", len(entries))
+	for _, e := range entries {
+		b, _ := json.Marshal(e)
+		reply += fmt.Sprintf("$%d\r\n%s\r\n", len(b), b)
+	}
+	return reply
+}
+
+func TestRequeueQuarantined(t *testing.T) {
+	entry := quarantineEntry{ID: "e1", Queue: "queue:go", Reason: "bad", Payload: `{"class":"RubyWorker","args":[5]}`}
+	list := quarantineList(quarantineEntry{ID: "e0", Queue: "queue:go"}, entry)
+	rw, out := fakeRedis(list + "+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n:0\r\n:1\r\n:1\r\n")
+	if _, err := requeueQuarantined(rw, "poison", "e1"); err != nil {
+		t.Fatalf("requeue error: %v", err)
+	}
+	cmd := out.String()
+	for _, want := range []string{
+		"$4\r\nSADD\r\n$6\r\nqueues\r\n$2\r\ngo\r\n",
+		"$5\r\nLPUSH\r\n$8\r\nqueue:go\r\n$33\r\n" + entry.Payload + "\r\n",
+		"$4\r\nLREM\r\n$6\r\npoison\r\n$1\r\n1\r\n",
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Fatalf("expected %q in %q", want, cmd)
+		}
+	}
+}
+
+func TestDeleteQuarantinedMissingEntry(t *testing.T) {
+	rw, out := fakeRedis(quarantineList(quarantineEntry{ID: "e0"}))
+	if err := deleteQuarantined(rw, "poison", "nope"); !errors.Is(err, errNoQuarantineEntry) {
+		t.Fatalf("expected missing entry error, got %v", err)
+	}
+	if strings.Contains(out.String(), "LREM") {
+		t.Fatalf("nothing should be removed: %q", out.String())
+	}
+}
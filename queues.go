@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// queueList is the set of queues a process listens on, parsed from a list
+// like "critical,go,default" (strict priority) or "critical:3,go:1"
+// (weighted). As in Sidekiq, giving any queue a weight switches to weighted
+// mode, where each fetch checks queues in a random order biased by weight.
+type queueList struct {
+	names   []string
+	weights []int
+	strict  bool
+}
+
+// queueShuffle shuffles n elements; replaced in tests.
+var queueShuffle = rand.Shuffle
+
+func parseQueueList(spec string) (queueList, error) {
+	ql := queueList{strict: true}
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, weightStr, hasWeight := strings.Cut(entry, ":")
+		weight := 0
+		if hasWeight {
+			w, err := strconv.Atoi(weightStr)
+			if err != nil || w < 1 {
+				return queueList{}, fmt.Errorf("invalid weight for queue %q: %q", name, weightStr)
+			}
+			weight = w
+			ql.strict = false
+		}
+		if name == "" {
+			return queueList{}, fmt.Errorf("empty queue name in %q", spec)
+		}
+		if seen[name] {
+			return queueList{}, fmt.Errorf("queue %q listed twice", name)
+		}
+		seen[name] = true
+		ql.names = append(ql.names, name)
+		ql.weights = append(ql.weights, weight)
+	}
+	if len(ql.names) == 0 {
+		ql.names, ql.weights = []string{"default"}, []int{0}
+	}
+	if !ql.strict {
+		// Queues listed without a weight in weighted mode count once.
+		for i, w := range ql.weights {
+			if w == 0 {
+				ql.weights[i] = 1
+			}
+		}
+	}
+	return ql, nil
+}
+
+// keys returns the Redis list keys in configured order.
+func (q queueList) keys() []string {
+	keys := make([]string, len(q.names))
+	for i, name := range q.names {
+		keys[i] = "queue:" + name
+	}
+	return keys
+}
+
+// fetchOrder returns the Redis list keys to check for the next fetch. In
+// weighted mode each queue appears weight times before shuffling, and only
+// its first occurrence is kept.
+func (q queueList) fetchOrder() []string {
+	if q.strict {
+		return q.keys()
+	}
+	var candidates []string
+	for i, name := range q.names {
+		for n := 0; n < q.weights[i]; n++ {
+			candidates = append(candidates, name)
+		}
+	}
+	queueShuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	seen := map[string]bool{}
+	order := make([]string, 0, len(q.names))
+	for _, name := range candidates {
+		if !seen[name] {
+			seen[name] = true
+			order = append(order, "queue:"+name)
+		}
+	}
+	return order
+}
+
+// weightMap is the queue => weight map shown in the process info.
+func (q queueList) weightMap() map[string]int {
+	m := make(map[string]int, len(q.names))
+	for i, name := range q.names {
+		m[name] = q.weights[i]
+	}
+	return m
+}
+
+func (q queueList) String() string {
+	parts := make([]string, len(q.names))
+	for i, name := range q.names {
+		parts[i] = name
+		if !q.strict {
+			parts[i] += ":" + strconv.Itoa(q.weights[i])
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestParseQueueListStrict(t *testing.T) {
+	ql, err := parseQueueList("critical, go,default")
+	if err != nil {
+		t.Fatalf("parseQueueList error: %v", err)
+	}
+	if !ql.strict {
+		t.Fatalf("expected strict mode without weights")
+	}
+	want := []string{"queue:critical", "queue:go", "queue:default"}
+	if got := ql.fetchOrder(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected fetch order: %v", got)
+	}
+}
+
+func TestParseQueueListWeighted(t *testing.T) {
+	ql, err := parseQueueList("critical:3,go:1,default")
+	if err != nil {
+		t.Fatalf("parseQueueList error: %v", err)
+	}
+	if ql.strict {
+		t.Fatalf("expected weighted mode")
+	}
+	if want := map[string]int{"critical": 3, "go": 1, "default": 1}; !reflect.DeepEqual(ql.weightMap(), want) {
+		t.Fatalf("unexpected weights: %v", ql.weightMap())
+	}
+	if ql.String() != "critical:3,go:1,default:1" {
+		t.Fatalf("unexpected string: %s", ql.String())
+	}
+}
+
+func TestWeightedFetchOrderIsUniqueAndShuffled(t *testing.T) {
+	ql, _ := parseQueueList("critical:3,go:1")
+
+	// Reverse instead of shuffling: go comes first, critical only once.
+	queueShuffle = func(n int, swap func(i, j int)) {
+		for i := 0; i < n/2; i++ {
+			swap(i, n-1-i)
+		}
+	}
+	t.Cleanup(func() { queueShuffle = rand.Shuffle })
+
+	want := []string{"queue:go", "queue:critical"}
+	if got := ql.fetchOrder(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected fetch order: %v", got)
+	}
+}
+
+func TestParseQueueListErrors(t *testing.T) {
+	for _, spec := range []string{"go:0", "go:x", "go,go", ":2"} {
+		if _, err := parseQueueList(spec); err == nil {
+			t.Fatalf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestParseQueueListDefault(t *testing.T) {
+	ql, err := parseQueueList("")
+	if err != nil {
+		t.Fatalf("parseQueueList error: %v", err)
+	}
+	if !reflect.DeepEqual(ql.keys(), []string{"queue:default"}) {
+		t.Fatalf("unexpected default queues: %v", ql.keys())
+	}
+}
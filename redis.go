@@ -2,19 +2,10 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"strconv"
 )
 
-type sidekiqJob struct {
-	Class string            `json:"class"`
-	Args  []json.RawMessage `json:"args"`
-	Queue string            `json:"queue"`
-}
-
 func writeCommand(w *bufio.ReadWriter, cmd string, args ...string) error {
 	if _, err := fmt.Fprintf(w, "*%d\r\n", 1+len(args)); err != nil {
 		return err
@@ -51,107 +42,139 @@ func readLine(r *bufio.Reader) (string, error) {
 }
 
 func readOK(rw *bufio.ReadWriter) error {
-	line, err := readLine(rw.Reader)
+	v, err := readReply(rw)
 	if err != nil {
 		return err
 	}
-	if len(line) > 0 && line[0] == '+' {
-		return nil
+	if v.kind != respSimple {
+		return fmt.Errorf("redis not OK: %s", v)
 	}
-	return fmt.Errorf("redis not OK: %s", line)
+	return nil
 }
 
-func readBRPOP(rw *bufio.ReadWriter) (key string, payload string, err error) {
-	line, err2 := readLine(rw.Reader)
-	if err2 != nil {
-		return "", "", err2
-	}
-	if len(line) == 0 {
-		return "", "", fmt.Errorf("empty reply")
-	}
-	switch line[0] {
-	case '*':
-		n, err := parseArrayLen(line)
-		if err != nil {
-			return "", "", err
-		}
-		// Redis returns *-1 for nil (timeout) on BRPOP.
-		if n <= 0 {
-			return "", "", nil
-		}
-		if n != 2 {
-			// Defensive: consume elements to keep stream aligned.
-			for i := 0; i < n; i++ {
-				if _, err := readBulkString(rw.Reader); err != nil {
-					return "", "", err
-				}
-			}
-			return "", "", fmt.Errorf("unexpected BRPOP array length: %d", n)
-		}
-		key, err = readBulkString(rw.Reader)
-		if err != nil {
-			return "", "", err
+// readOptionalOK reads the reply of SET NX: +OK when the key was set, a nil
+// bulk string when it was not.
+func readOptionalOK(rw *bufio.ReadWriter) (bool, error) {
+	v, err := readReply(rw)
+	if err != nil {
+		return false, err
+	}
+	switch v.kind {
+	case respNull:
+		return false, nil
+	case respSimple:
+		return true, nil
+	}
+	return false, fmt.Errorf("unexpected reply: %s", v)
+}
+
+func readInteger(rw *bufio.ReadWriter) (int64, error) {
+	v, err := readReply(rw)
+	if err != nil {
+		return 0, err
+	}
+	if v.kind != respInteger {
+		return 0, fmt.Errorf("unexpected reply: %s", v)
+	}
+	return v.num, nil
+}
+
+// readStringArray reads an array (or RESP3 set) of strings. A nil reply
+// yields nil and nil elements are returned as "".
+func readStringArray(rw *bufio.ReadWriter) ([]string, error) {
+	v, err := readReply(rw)
+	if err != nil {
+		return nil, err
+	}
+	return stringsOf(v)
+}
+
+func stringsOf(v respValue) ([]string, error) {
+	if v.isNull() {
+		return nil, nil
+	}
+	if v.kind != respArray && v.kind != respSet {
+		return nil, fmt.Errorf("expected array, got %s", v)
+	}
+	if len(v.elems) == 0 {
+		return nil, nil
+	}
+	out := make([]string, 0, len(v.elems))
+	for _, e := range v.elems {
+		s, ok := e.text()
+		if !ok && !e.isNull() {
+			return nil, fmt.Errorf("expected string element, got %s", e)
 		}
-		payload, err = readBulkString(rw.Reader)
-		if err != nil {
-			return "", "", err
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// execMulti runs commands in a MULTI/EXEC block and returns their replies.
+// A command that fails inside the transaction fails the call with its
+// *redisError.
+func execMulti(rw *bufio.ReadWriter, cmds [][]string) ([]respValue, error) {
+	if err := writeCommand(rw, "MULTI"); err != nil {
+		return nil, err
+	}
+	if err := readOK(rw); err != nil {
+		return nil, err
+	}
+	for _, c := range cmds {
+		if err := writeCommand(rw, c[0], c[1:]...); err != nil {
+			return nil, err
 		}
-		return key, payload, nil
-	case '$':
-		if line == "$-1" {
-			return "", "", nil
+		if err := readOK(rw); err != nil {
+			return nil, err
 		}
-		l, _ := strconv.Atoi(line[1:])
-		buf := make([]byte, l)
-		if _, err := rw.Reader.Read(buf); err != nil {
-			return "", "", ioEOF
+	}
+	v, err := redisDo(rw, "EXEC")
+	if err != nil {
+		return nil, err
+	}
+	if v.kind != respArray || len(v.elems) != len(cmds) {
+		return nil, fmt.Errorf("transaction aborted")
+	}
+	for i, e := range v.elems {
+		if e.kind == respError {
+			return nil, fmt.Errorf("%s failed: %w", cmds[i][0], newRedisError(e.str))
 		}
-		rw.Reader.ReadByte()
-		rw.Reader.ReadByte()
-		return "", string(buf), nil
-	case '-':
-		return "", "", fmt.Errorf("redis error: %s", line)
-	default:
-		return "", "", fmt.Errorf("unexpected reply: %s", line)
 	}
+	return v.elems, nil
 }
 
-func parseArrayLen(line string) (int, error) {
-	if len(line) < 2 || line[0] != '*' {
-		return 0, fmt.Errorf("invalid array reply: %q", line)
+// readBRPOP reads a BRPOP reply: the queue key and payload, or two empty
+// strings when the command timed out.
+func readBRPOP(rw *bufio.ReadWriter) (key string, payload string, err error) {
+	v, err := readReply(rw)
+	if err != nil {
+		return "", "", err
 	}
-	n, err := strconv.Atoi(line[1:])
+	if v.isNull() || (v.kind == respArray && len(v.elems) == 0) {
+		return "", "", nil
+	}
+	parts, err := stringsOf(v)
 	if err != nil {
-		return 0, fmt.Errorf("invalid array length: %q", line)
+		return "", "", err
+	}
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("unexpected BRPOP array length: %d", len(parts))
 	}
-	return n, nil
+	return parts[0], parts[1], nil
 }
 
+// readBulkString reads a string reply; a nil reply yields "".
 func readBulkString(r *bufio.Reader) (string, error) {
-	header, err := readLine(r)
+	v, err := readReply(&bufio.ReadWriter{Reader: r})
 	if err != nil {
 		return "", err
 	}
-	if len(header) == 0 || header[0] != '$' {
-		return "", fmt.Errorf("expected bulk string, got %q", header)
-	}
-	if header == "$-1" {
+	if v.isNull() {
 		return "", nil
 	}
-	l, err := strconv.Atoi(header[1:])
-	if err != nil {
-		return "", fmt.Errorf("invalid bulk length: %q", header)
-	}
-	buf := make([]byte, l)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return "", ioEOF
-	}
-	// consume CRLF
-	if _, err := r.ReadByte(); err != nil {
-		return "", ioEOF
-	}
-	if _, err := r.ReadByte(); err != nil {
-		return "", ioEOF
+	s, ok := v.text()
+	if !ok {
+		return "", fmt.Errorf("expected bulk string, got %s", v)
 	}
-	return string(buf), nil
+	return s, nil
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type redisConfig struct {
+	URL string
+	// Network is "tcp", or "unix" with Host holding the socket path.
+	Network string
+	Host    string
+	// Username is the ACL user; empty means Redis' default user.
+	Username string
+	Password string
+	DB       int
+	// TLS is set for rediss:// URLs.
+	TLS *tls.Config
+}
+
+// user is the ACL user the connection authenticates as.
+func (c redisConfig) user() string {
+	if c.Username == "" {
+		return "default"
+	}
+	return c.Username
+}
+
+func redisConfigFromEnv() (redisConfig, error) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		redisURL = "redis://localhost:6379/0"
+	}
+	cfg, err := parseRedisURL(redisURL)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.TLS == nil {
+		if name := redisTLSEnvSet(); name != "" {
+			return cfg, fmt.Errorf("%s is set but REDIS_URL does not use rediss://", name)
+		}
+		return cfg, nil
+	}
+	cfg.TLS, err = redisTLSConfigFromEnv(cfg.TLS.ServerName)
+	return cfg, err
+}
+
+func parseRedisURL(redisURL string) (redisConfig, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return redisConfig{}, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	if u.Scheme == "unix" {
+		return parseUnixRedisURL(redisURL, u)
+	}
+	cfg := redisConfig{URL: redisURL, Network: "tcp", Host: u.Host}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		cfg.TLS = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return redisConfig{}, fmt.Errorf("invalid REDIS_URL: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		cfg.Host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	cfg.Username = u.User.Username()
+	cfg.Password, _ = u.User.Password()
+	if parts := strings.TrimPrefix(u.Path, "/"); parts != "" {
+		if i, err := strconv.Atoi(parts); err == nil {
+			cfg.DB = i
+		}
+	}
+	return cfg, nil
+}
+
+// parseUnixRedisURL reads unix:///path/to/redis.sock?db=N. Credentials may be
+// given as user info (unix://user:pass@/path) or as username and password
+// parameters.
+func parseUnixRedisURL(redisURL string, u *url.URL) (redisConfig, error) {
+	if u.Host != "" || u.Path == "" {
+		return redisConfig{}, errors.New("invalid REDIS_URL: want unix:///path/to/redis.sock")
+	}
+	cfg := redisConfig{URL: redisURL, Network: "unix", Host: u.Path}
+	cfg.Username = u.User.Username()
+	cfg.Password, _ = u.User.Password()
+	query := u.Query()
+	if user := query.Get("username"); user != "" {
+		cfg.Username = user
+	}
+	if pw := query.Get("password"); pw != "" {
+		cfg.Password = pw
+	}
+	if db := query.Get("db"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return redisConfig{}, fmt.Errorf("invalid REDIS_URL: db %q", db)
+		}
+		cfg.DB = n
+	}
+	return cfg, nil
+}
+
+// dialRedis opens a TCP or unix socket connection, over TLS for rediss://,
+// and runs the handshake.
+func dialRedis(cfg redisConfig) (net.Conn, *bufio.ReadWriter, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if cfg.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.Host, cfg.TLS)
+	} else {
+		conn, err = dialer.Dial(cfg.Network, cfg.Host)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("redis connect failed: %w", err)
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err := handshake(rw, cfg); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// handshake switches the connection to RESP3 with HELLO 3, authenticating in
+// the same command, then selects the database. Servers older than Redis 6
+// reject HELLO; they get a plain AUTH and stay on RESP2.
+func handshake(rw *bufio.ReadWriter, cfg redisConfig) error {
+	args := []string{"3"}
+	if cfg.Password != "" {
+		args = append(args, "AUTH", cfg.user(), cfg.Password)
+	}
+	_, err := redisDo(rw, "HELLO", args...)
+	switch {
+	case err == nil:
+	case isRedisError(err, "ERR") || isRedisError(err, "NOPROTO"):
+		if err := auth(rw, cfg); err != nil {
+			return err
+		}
+	case cfg.Password != "":
+		return handshakeError(cfg, "auth", "HELLO", err)
+	default:
+		return handshakeError(cfg, "hello", "HELLO", err)
+	}
+	if cfg.DB != 0 {
+		if _, err := redisDo(rw, "SELECT", strconv.Itoa(cfg.DB)); err != nil {
+			return handshakeError(cfg, "select", "SELECT", err)
+		}
+	}
+	return nil
+}
+
+// auth authenticates a RESP2 connection: AUTH <user> <password> when the
+// URL names an ACL user, falling back to the legacy AUTH <password> on
+// servers that predate ACLs.
+func auth(rw *bufio.ReadWriter, cfg redisConfig) error {
+	if cfg.Password == "" {
+		return nil
+	}
+	if cfg.Username != "" {
+		_, err := redisDo(rw, "AUTH", cfg.Username, cfg.Password)
+		if err == nil {
+			return nil
+		}
+		if !isRedisError(err, "ERR") {
+			return handshakeError(cfg, "auth", "AUTH", err)
+		}
+		// Redis 5 and older answer "wrong number of arguments".
+		log.Printf("[go_worker] redis does not support ACL users; authenticating without username %q", cfg.Username)
+	}
+	if _, err := redisDo(rw, "AUTH", cfg.Password); err != nil {
+		return handshakeError(cfg, "auth", "AUTH", err)
+	}
+	return nil
+}
+
+// handshakeError explains the ACL failures an operator can fix: a wrong
+// username or password, or a user whose rules forbid a handshake command.
+func handshakeError(cfg redisConfig, step, cmd string, err error) error {
+	switch {
+	case isRedisError(err, "WRONGPASS"):
+		return fmt.Errorf("redis auth failed: wrong password for user %q, or the user does not exist or is disabled: %w", cfg.user(), err)
+	case isRedisError(err, "NOPERM"):
+		return fmt.Errorf("redis %s failed: user %q is not allowed to run %s; check its ACL rules: %w", step, cfg.user(), cmd, err)
+	}
+	return fmt.Errorf("redis %s failed: %w", step, err)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisPoolSize    = 5
+	defaultRedisIdleTimeout = 4 * time.Minute
+	// redisCommandTimeout bounds one borrow of a pooled connection, so a
+	// server that stops answering fails the caller instead of hanging it.
+	redisCommandTimeout = 30 * time.Second
+)
+
+var errRedisClientClosed = errors.New("redis client closed")
+
+// redisConn is a connection that has completed the handshake.
+type redisConn struct {
+	net.Conn
+	rw        *bufio.ReadWriter
+	idleSince time.Time
+}
+
+// redisClient hands out short command connections from a bounded pool.
+// Every new connection runs the AUTH/SELECT handshake; a pooled one is
+// PINGed before it is reused and closed once it has been idle longer than
+// idleTimeout. Blocking commands such as BRPOP would hold a pooled
+// connection indefinitely, so the processors take dedicated connections
+// from dialBlocking instead.
+type redisClient struct {
+	cfg         redisConfig
+	idleTimeout time.Duration
+	// dial opens and handshakes a connection; replaced in tests.
+	dial func(redisConfig) (net.Conn, *bufio.ReadWriter, error)
+	// slots holds one token per connection that is checked out.
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*redisConn
+	closed bool
+}
+
+func newRedisClient(cfg redisConfig, size int, idleTimeout time.Duration) *redisClient {
+	if size < 1 {
+		size = 1
+	}
+	return &redisClient{
+		cfg:         cfg,
+		idleTimeout: idleTimeout,
+		dial:        dialRedis,
+		slots:       make(chan struct{}, size),
+	}
+}
+
+// withConn borrows a connection, runs fn on it and hands it back. A
+// connection fn failed on is closed rather than reused, since a half-read
+// reply or an open MULTI would corrupt the next borrower's commands.
+func (c *redisClient) withConn(fn func(rw *bufio.ReadWriter) error) error {
+	conn, err := c.get()
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(redisCommandTimeout))
+	err = fn(conn.rw)
+	c.put(conn, err)
+	return err
+}
+
+// get waits for a free slot, then reuses the most recently idle connection
+// that still answers PING or dials a new one.
+func (c *redisClient) get() (*redisConn, error) {
+	c.slots <- struct{}{}
+	for {
+		conn, err := c.popIdle()
+		if err != nil {
+			<-c.slots
+			return nil, err
+		}
+		if conn == nil {
+			break
+		}
+		if c.idleTimeout > 0 && time.Since(conn.idleSince) > c.idleTimeout {
+			conn.Close()
+			continue
+		}
+		if err := ping(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+	netConn, rw, err := c.dial(c.cfg)
+	if err != nil {
+		<-c.slots
+		return nil, err
+	}
+	return &redisConn{Conn: netConn, rw: rw}, nil
+}
+
+func (c *redisClient) popIdle() (*redisConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errRedisClientClosed
+	}
+	if len(c.idle) == 0 {
+		return nil, nil
+	}
+	conn := c.idle[len(c.idle)-1]
+	c.idle = c.idle[:len(c.idle)-1]
+	return conn, nil
+}
+
+func (c *redisClient) put(conn *redisConn, err error) {
+	defer func() { <-c.slots }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil || c.closed {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	conn.idleSince = time.Now()
+	c.idle = append(c.idle, conn)
+}
+
+func ping(conn *redisConn) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	v, err := redisDo(conn.rw, "PING")
+	if err != nil {
+		return err
+	}
+	if s, _ := v.text(); s != "PONG" {
+		return fmt.Errorf("unexpected PING reply: %s", v)
+	}
+	return nil
+}
+
+// dialBlocking opens a connection outside the pool for a caller that blocks
+// on it, such as a processor's BRPOP loop. The caller closes it.
+func (c *redisClient) dialBlocking() (net.Conn, *bufio.ReadWriter, error) {
+	return c.dial(c.cfg)
+}
+
+// close closes the idle connections; borrowed ones are closed as they are
+// handed back.
+func (c *redisClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeServer answers commands on the far end of a net.Pipe, recording them.
+type pipeServer struct {
+	mu       sync.Mutex
+	commands []string
+	reply    func(cmd string) string
+}
+
+func (s *pipeServer) serve(conn net.Conn) {
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		v, err := readValue(rw.Reader)
+		if err != nil || len(v.elems) == 0 {
+			conn.Close()
+			return
+		}
+		cmd := v.elems[0].str
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+		rw.WriteString(s.reply(cmd))
+		rw.Flush()
+	}
+}
+
+func (s *pipeServer) seen() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func newPipeClient(size int, idleTimeout time.Duration, s *pipeServer) (*redisClient, *int) {
+	dials := 0
+	c := newRedisClient(redisConfig{}, size, idleTimeout)
+	c.dial = func(redisConfig) (net.Conn, *bufio.ReadWriter, error) {
+		dials++
+		client, server := net.Pipe()
+		go s.serve(server)
+		return client, bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client)), nil
+	}
+	return c, &dials
+}
+
+func pong(cmd string) string {
+	if cmd == "PING" {
+		return "+PONG\r\n"
+	}
+	return ":1\r\n"
+}
+
+func incr(rw *bufio.ReadWriter) error {
+	_, err := redisDo(rw, "INCR", "n")
+	return err
+}
+
+func TestRedisClientReusesConnections(t *testing.T) {
+	s := &pipeServer{reply: pong}
+	c, dials := newPipeClient(2, time.Minute, s)
+	defer c.close()
+
+	for i := 0; i < 3; i++ {
+		if err := c.withConn(incr); err != nil {
+			t.Fatalf("withConn error: %v", err)
+		}
+	}
+	if *dials != 1 {
+		t.Fatalf("expected one connection, dialed %d", *dials)
+	}
+	got := s.seen()
+	want := []string{"INCR", "PING", "INCR", "PING", "INCR"}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected commands: %q", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("unexpected commands: %q", got)
+		}
+	}
+}
+
+func TestRedisClientRedialsAfterFailedPing(t *testing.T) {
+	s := &pipeServer{reply: func(cmd string) string {
+		if cmd == "PING" {
+			return "-LOADING Redis is loading the dataset in memory\r\n"
+		}
+		return ":1\r\n"
+	}}
+	c, dials := newPipeClient(1, time.Minute, s)
+	defer c.close()
+
+	for i := 0; i < 2; i++ {
+		if err := c.withConn(incr); err != nil {
+			t.Fatalf("withConn error: %v", err)
+		}
+	}
+	if *dials != 2 {
+		t.Fatalf("expected a new connection after the failed PING, dialed %d", *dials)
+	}
+}
+
+func TestRedisClientDropsIdleConnections(t *testing.T) {
+	s := &pipeServer{reply: pong}
+	c, dials := newPipeClient(1, time.Minute, s)
+	defer c.close()
+
+	if err := c.withConn(incr); err != nil {
+		t.Fatalf("withConn error: %v", err)
+	}
+	c.idle[0].idleSince = time.Now().Add(-2 * time.Minute)
+	if err := c.withConn(incr); err != nil {
+		t.Fatalf("withConn error: %v", err)
+	}
+	if *dials != 2 {
+		t.Fatalf("expected the idle connection to be replaced, dialed %d", *dials)
+	}
+	for _, cmd := range s.seen() {
+		if cmd == "PING" {
+			t.Fatalf("expected no PING on an expired connection")
+		}
+	}
+}
+
+func TestRedisClientDiscardsConnectionOnError(t *testing.T) {
+	s := &pipeServer{reply: pong}
+	c, dials := newPipeClient(1, time.Minute, s)
+	defer c.close()
+
+	boom := errors.New("boom")
+	if err := c.withConn(func(*bufio.ReadWriter) error { return boom }); err != boom {
+		t.Fatalf("expected fn error, got %v", err)
+	}
+	if len(c.idle) != 0 {
+		t.Fatalf("expected the failed connection not to be pooled")
+	}
+	if err := c.withConn(incr); err != nil {
+		t.Fatalf("withConn error: %v", err)
+	}
+	if *dials != 2 {
+		t.Fatalf("expected a fresh connection, dialed %d", *dials)
+	}
+}
+
+func TestRedisClientBoundsConnections(t *testing.T) {
+	s := &pipeServer{reply: pong}
+	c, _ := newPipeClient(1, time.Minute, s)
+	defer c.close()
+
+	release := make(chan struct{})
+	holding := make(chan struct{})
+	go c.withConn(func(*bufio.ReadWriter) error {
+		close(holding)
+		<-release
+		return nil
+	})
+	<-holding
+
+	borrowed := make(chan struct{})
+	go func() {
+		c.withConn(incr)
+		close(borrowed)
+	}()
+	select {
+	case <-borrowed:
+		t.Fatalf("expected the second borrow to wait for a free connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-borrowed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the second borrow once the connection was returned")
+	}
+}
+
+func TestRedisClientClosed(t *testing.T) {
+	s := &pipeServer{reply: pong}
+	c, _ := newPipeClient(1, time.Minute, s)
+	c.close()
+	if err := c.withConn(incr); !errors.Is(err, errRedisClientClosed) {
+		t.Fatalf("expected errRedisClientClosed, got %v", err)
+	}
+}
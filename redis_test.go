@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestWriteCommand(t *testing.T) {
@@ -22,7 +25,7 @@ func TestWriteCommand(t *testing.T) {
 }
 
 func TestReadBRPOPMultiBulk(t *testing.T) {
-	payload := "*2\r\n$5\r\nqueue\r\n$11\r\n{\"foo\":\"bar\"}\r\n"
+	payload := "*2\r\n$5\r\nqueue\r\n$13\r\n{\"foo\":\"bar\"}\r\n"
 	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(payload)), bufio.NewWriter(io.Discard))
 
 	key, msg, err := readBRPOP(rw)
@@ -54,3 +57,89 @@ func TestReadBRPOPTimeout(t *testing.T) {
 		}
 	}
 }
+
+func TestReadInteger(t *testing.T) {
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(":42\r\n")), bufio.NewWriter(io.Discard))
+	n, err := readInteger(rw)
+	if err != nil {
+		t.Fatalf("readInteger error: %v", err)
+	}
+	if n != 42 {
+		t.Fatalf("expected 42, got %d", n)
+	}
+
+	rw = bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString("-WRONGTYPE oops\r\n")), bufio.NewWriter(io.Discard))
+	if _, err := readInteger(rw); err == nil {
+		t.Fatalf("expected error for error reply")
+	}
+}
+
+func TestReadStringArray(t *testing.T) {
+	payload := "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(payload)), bufio.NewWriter(io.Discard))
+	got, err := readStringArray(rw)
+	if err != nil {
+		t.Fatalf("readStringArray error: %v", err)
+	}
+	if len(got) != 2 || got[0] != "a" || got[1] != "bc" {
+		t.Fatalf("unexpected array: %q", got)
+	}
+}
+
+func TestReadBRPOPLargePayload(t *testing.T) {
+	big := strings.Repeat("x", 100000)
+	payload := "*2\r\n$11\r\nqueue:large\r\n$" + strconv.Itoa(len(big)) + "\r\n" + big + "\r\n"
+	r := bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(payload)), 16)
+	rw := bufio.NewReadWriter(r, bufio.NewWriter(io.Discard))
+
+	key, msg, err := readBRPOP(rw)
+	if err != nil {
+		t.Fatalf("readBRPOP error: %v", err)
+	}
+	if key != "queue:large" || msg != big {
+		t.Fatalf("unexpected reply: %q and %d bytes", key, len(msg))
+	}
+}
+
+func TestReadBRPOPRESP3Null(t *testing.T) {
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString("_\r\n")), bufio.NewWriter(io.Discard))
+	key, msg, err := readBRPOP(rw)
+	if err != nil || key != "" || msg != "" {
+		t.Fatalf("expected empty timeout result, got %q %q %v", key, msg, err)
+	}
+}
+
+func TestExecMultiReturnsReplies(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:1\r\n$3\r\nfoo\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+
+	got, err := execMulti(rw, [][]string{{"INCR", "a"}, {"GET", "b"}})
+	if err != nil {
+		t.Fatalf("execMulti error: %v", err)
+	}
+	if len(got) != 2 || got[0].num != 1 || got[1].str != "foo" {
+		t.Fatalf("unexpected replies: %v", got)
+	}
+}
+
+func TestExecMultiFailsOnCommandError(t *testing.T) {
+	replies := "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:1\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(io.Discard))
+
+	_, err := execMulti(rw, [][]string{{"INCR", "a"}, {"LPUSH", "b", "c"}})
+	if !isRedisError(err, "WRONGTYPE") {
+		t.Fatalf("expected WRONGTYPE error, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "LPUSH failed") {
+		t.Fatalf("expected the failing command in the error, got %v", err)
+	}
+}
+
+func TestExecMultiAborted(t *testing.T) {
+	replies := "+OK\r\n+QUEUED\r\n*-1\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(io.Discard))
+	if _, err := execMulti(rw, [][]string{{"INCR", "a"}}); err == nil {
+		t.Fatalf("expected error for aborted transaction")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// redisTLSEnv lists the variables that configure rediss:// connections.
+var redisTLSEnv = []string{
+	"REDIS_TLS_CA_FILE",
+	"REDIS_TLS_CERT_FILE",
+	"REDIS_TLS_KEY_FILE",
+	"REDIS_TLS_SERVER_NAME",
+	"REDIS_TLS_INSECURE_SKIP_VERIFY",
+}
+
+// redisTLSConfigFromEnv builds the TLS settings for a rediss:// URL whose
+// host is serverName:
+//
+//   - REDIS_TLS_CA_FILE: PEM bundle to verify the server with instead of the
+//     system roots
+//   - REDIS_TLS_CERT_FILE, REDIS_TLS_KEY_FILE: client certificate and key
+//   - REDIS_TLS_SERVER_NAME: name to send as SNI and verify the certificate
+//     against, for servers reached through an IP or a tunnel
+//   - REDIS_TLS_INSECURE_SKIP_VERIFY: skip certificate verification entirely
+func redisTLSConfigFromEnv(serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if name := os.Getenv("REDIS_TLS_SERVER_NAME"); name != "" {
+		cfg.ServerName = name
+	}
+	if path := os.Getenv("REDIS_TLS_CA_FILE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_TLS_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("REDIS_TLS_CA_FILE: no certificates found in %s", path)
+		}
+		cfg.RootCAs = pool
+	}
+	certFile, keyFile := os.Getenv("REDIS_TLS_CERT_FILE"), os.Getenv("REDIS_TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if v := os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY"); v != "" {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_TLS_INSECURE_SKIP_VERIFY: %q", v)
+		}
+		if skip {
+			log.Printf("[go_worker] WARNING: REDIS_TLS_INSECURE_SKIP_VERIFY is set; the Redis server certificate is not verified")
+			cfg.InsecureSkipVerify = true
+		}
+	}
+	return cfg, nil
+}
+
+// redisTLSEnvSet returns the first TLS variable that is set, so settings
+// meant for a rediss:// URL are not silently ignored on a plain one.
+func redisTLSEnvSet() string {
+	for _, name := range redisTLSEnv {
+		if os.Getenv(name) != "" {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issueCert creates a certificate for name signed by parent, or a
+// self-signed CA when parent is nil.
+func issueCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		tmpl.DNSNames = []string{name}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// writePEM writes the certificate and its key to dir and returns their paths.
+func (c *testCert) writePEM(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certPath, keyPath
+}
+
+// startTLSRedis serves RESP over TLS as redis.internal on a local port and
+// reports whether each client presented a certificate.
+func startTLSRedis(t *testing.T, ca, server *testCert) (string, <-chan bool) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	clientCerts := make(chan bool, 4)
+	s := &pipeServer{reply: func(cmd string) string {
+		if cmd == "HELLO" {
+			return "%1\r\n+proto\r\n:3\r\n"
+		}
+		return "+PONG\r\n"
+	}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			if tc.Handshake() == nil {
+				clientCerts <- len(tc.ConnectionState().PeerCertificates) > 0
+			}
+			go s.serve(tc)
+		}
+	}()
+	return ln.Addr().String(), clientCerts
+}
+
+func clearRedisTLSEnv(t *testing.T) {
+	for _, name := range redisTLSEnv {
+		t.Setenv(name, "")
+	}
+}
+
+func TestParseRedisURLTLS(t *testing.T) {
+	cfg, err := parseRedisURL("rediss://:pw@cache.example/1")
+	if err != nil {
+		t.Fatalf("parseRedisURL error: %v", err)
+	}
+	if cfg.TLS == nil || cfg.TLS.ServerName != "cache.example" || cfg.Host != "cache.example:6379" || cfg.DB != 1 {
+		t.Fatalf("unexpected config: %#v", cfg)
+	}
+	if _, err := parseRedisURL("http://cache.example"); err == nil {
+		t.Fatalf("expected error for unsupported scheme")
+	}
+}
+
+func TestDialRedisTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, "test ca", nil, x509.ExtKeyUsageAny)
+	server := issueCert(t, "redis.internal", ca, x509.ExtKeyUsageServerAuth)
+	client := issueCert(t, "go_worker", ca, x509.ExtKeyUsageClientAuth)
+	caPath, _ := ca.writePEM(t, dir, "ca")
+	certPath, keyPath := client.writePEM(t, dir, "client")
+	addr, clientCerts := startTLSRedis(t, ca, server)
+
+	clearRedisTLSEnv(t)
+	t.Setenv("REDIS_URL", "rediss://"+addr)
+	t.Setenv("REDIS_TLS_CA_FILE", caPath)
+	t.Setenv("REDIS_TLS_CERT_FILE", certPath)
+	t.Setenv("REDIS_TLS_KEY_FILE", keyPath)
+
+	// The certificate names redis.internal, not the address dialed.
+	cfg, err := redisConfigFromEnv()
+	if err != nil {
+		t.Fatalf("redisConfigFromEnv error: %v", err)
+	}
+	if _, _, err := dialRedis(cfg); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error without the SNI override, got %v", err)
+	}
+
+	t.Setenv("REDIS_TLS_SERVER_NAME", "redis.internal")
+	cfg, err = redisConfigFromEnv()
+	if err != nil {
+		t.Fatalf("redisConfigFromEnv error: %v", err)
+	}
+	conn, rw, err := dialRedis(cfg)
+	if err != nil {
+		t.Fatalf("dialRedis error: %v", err)
+	}
+	defer conn.Close()
+	if v, err := redisDo(rw, "PING"); err != nil || v.str != "PONG" {
+		t.Fatalf("unexpected PING reply: %s %v", v, err)
+	}
+	if !<-clientCerts {
+		t.Fatalf("expected the client certificate to be presented")
+	}
+}
+
+func TestDialRedisTLSInsecureSkipVerify(t *testing.T) {
+	ca := issueCert(t, "test ca", nil, x509.ExtKeyUsageAny)
+	server := issueCert(t, "redis.internal", ca, x509.ExtKeyUsageServerAuth)
+	addr, clientCerts := startTLSRedis(t, ca, server)
+
+	clearRedisTLSEnv(t)
+	t.Setenv("REDIS_URL", "rediss://"+addr)
+	t.Setenv("REDIS_TLS_INSECURE_SKIP_VERIFY", "true")
+	cfg, err := redisConfigFromEnv()
+	if err != nil {
+		t.Fatalf("redisConfigFromEnv error: %v", err)
+	}
+	conn, _, err := dialRedis(cfg)
+	if err != nil {
+		t.Fatalf("dialRedis error: %v", err)
+	}
+	conn.Close()
+	if <-clientCerts {
+		t.Fatalf("expected no client certificate")
+	}
+}
+
+func TestRedisTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0o600)
+
+	for _, tc := range []struct {
+		url string
+		env map[string]string
+	}{
+		{"redis://localhost", map[string]string{"REDIS_TLS_CA_FILE": empty}},
+		{"rediss://localhost", map[string]string{"REDIS_TLS_CA_FILE": empty}},
+		{"rediss://localhost", map[string]string{"REDIS_TLS_CA_FILE": filepath.Join(dir, "missing.pem")}},
+		{"rediss://localhost", map[string]string{"REDIS_TLS_CERT_FILE": empty}},
+		{"rediss://localhost", map[string]string{"REDIS_TLS_CERT_FILE": empty, "REDIS_TLS_KEY_FILE": empty}},
+		{"rediss://localhost", map[string]string{"REDIS_TLS_INSECURE_SKIP_VERIFY": "maybe"}},
+	} {
+		clearRedisTLSEnv(t)
+		t.Setenv("REDIS_URL", tc.url)
+		for k, v := range tc.env {
+			t.Setenv(k, v)
+		}
+		if _, err := redisConfigFromEnv(); err == nil {
+			t.Errorf("expected error for %s with %v", tc.url, tc.env)
+		}
+	}
+}
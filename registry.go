@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobHandler runs one job of a registered class. Returning an error fails
+// the job, sending it through the retry and dead sets; wrap errBadArgs for
+// payloads that can never succeed.
+type jobHandler func(ctx context.Context, job *sidekiqJob) error
+
+// errBadArgs marks a job whose arguments the handler cannot use. Such jobs
+// are not retried but moved to the quarantine list.
+var errBadArgs = errors.New("invalid job arguments")
+
+// registry maps Sidekiq job class names to the Go handlers that run them.
+type registry struct {
+	mu       sync.RWMutex
+	handlers map[string]jobHandler
+}
+
+func newRegistry() *registry {
+	return &registry{handlers: map[string]jobHandler{}}
+}
+
+// register adds a handler for class, replacing any earlier one.
+func (r *registry) register(class string, h jobHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[class] = h
+}
+
+func (r *registry) lookup(class string) (jobHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[class]
+	return h, ok
+}
+
+// classes lists the registered class names in sorted order.
+func (r *registry) classes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, 0, len(r.handlers))
+	for class := range r.handlers {
+		out = append(out, class)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// unknownClassPolicy says what to do with a job whose class has no handler.
+type unknownClassPolicy string
+
+const (
+	unknownClassDrop    unknownClassPolicy = "drop"
+	unknownClassRequeue unknownClassPolicy = "requeue"
+	unknownClassForward unknownClassPolicy = "forward"
+	unknownClassDead    unknownClassPolicy = "dead"
+)
+
+// parseUnknownClassPolicy reads the policy, defaulting to forward when a
+// fallback queue is configured and to requeue otherwise, so a job this
+// worker cannot run is never silently lost.
+func parseUnknownClassPolicy(s, fallback string) (unknownClassPolicy, error) {
+	p := unknownClassPolicy(s)
+	switch p {
+	case "":
+		if fallback != "" {
+			return unknownClassForward, nil
+		}
+		return unknownClassRequeue, nil
+	case unknownClassForward:
+		if fallback == "" {
+			return "", fmt.Errorf("policy forward needs WORKER_FALLBACK_QUEUE")
+		}
+		return p, nil
+	case unknownClassDrop, unknownClassRequeue, unknownClassDead:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown policy %q (want requeue, forward, dead or drop)", s)
+	}
+}
+
+const (
+	bounceBackoffBase = 100 * time.Millisecond
+	bounceBackoffMax  = 10 * time.Second
+)
+
+// bounceBackoff is how long a processor pauses after handing back its n-th
+// consecutive job it could not run. Without it a worker alone on a queue
+// holding such a job would pop and push it back in a tight loop.
+func bounceBackoff(n int) time.Duration {
+	d := bounceBackoffBase
+	for i := 1; i < n && d < bounceBackoffMax; i++ {
+		d *= 2
+	}
+	if d > bounceBackoffMax {
+		d = bounceBackoffMax
+	}
+	return d
+}
+
+// unknownClassError is recorded on jobs sent to the dead set because no
+// handler is registered for their class.
+type unknownClassError struct {
+	class string
+}
+
+func (e unknownClassError) Error() string {
+	return fmt.Sprintf("no handler registered for job class %s", e.class)
+}
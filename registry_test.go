@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRegistryRegisterAndLookup(t *testing.T) {
+	r := newRegistry()
+	called := ""
+	r.register("BenchWorker", func(ctx context.Context, job *sidekiqJob) error {
+		called = job.Class
+		return nil
+	})
+
+	h, ok := r.lookup("BenchWorker")
+	if !ok {
+		t.Fatalf("expected BenchWorker to be registered")
+	}
+	if err := h(context.Background(), &sidekiqJob{Class: "BenchWorker"}); err != nil || called != "BenchWorker" {
+		t.Fatalf("handler not invoked correctly: %q %v", called, err)
+	}
+	if _, ok := r.lookup("Missing"); ok {
+		t.Fatalf("expected Missing to be unregistered")
+	}
+
+	r.register("AWorker", func(context.Context, *sidekiqJob) error { return nil })
+	if got := r.classes(); !reflect.DeepEqual(got, []string{"AWorker", "BenchWorker"}) {
+		t.Fatalf("unexpected classes: %v", got)
+	}
+}
+
+func TestParseUnknownClassPolicy(t *testing.T) {
+	cases := []struct {
+		policy, fallback string
+		want             unknownClassPolicy
+	}{
+		{"", "", unknownClassRequeue},
+		{"", "ruby", unknownClassForward},
+		{"forward", "ruby", unknownClassForward},
+		{"requeue", "ruby", unknownClassRequeue},
+		{"drop", "", unknownClassDrop},
+		{"dead", "", unknownClassDead},
+	}
+	for _, c := range cases {
+		got, err := parseUnknownClassPolicy(c.policy, c.fallback)
+		if err != nil || got != c.want {
+			t.Fatalf("parseUnknownClassPolicy(%q, %q) = %q, %v", c.policy, c.fallback, got, err)
+		}
+	}
+	if _, err := parseUnknownClassPolicy("ignore", ""); err == nil {
+		t.Fatalf("expected error for unsupported policy")
+	}
+	if _, err := parseUnknownClassPolicy("forward", ""); err == nil {
+		t.Fatalf("expected error for forward without a fallback queue")
+	}
+}
+
+func TestBounceBackoff(t *testing.T) {
+	if got := bounceBackoff(1); got != 100*time.Millisecond {
+		t.Fatalf("expected 100ms, got %v", got)
+	}
+	if got := bounceBackoff(4); got != 800*time.Millisecond {
+		t.Fatalf("expected 800ms, got %v", got)
+	}
+	if got := bounceBackoff(50); got != 10*time.Second {
+		t.Fatalf("expected cap of 10s, got %v", got)
+	}
+}
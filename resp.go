@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RESP reply types, named by their prefix byte. Null replies of every form
+// (RESP2 $-1 and *-1, RESP3 _) decode to respNull.
+const (
+	respSimple    byte = '+'
+	respError     byte = '-'
+	respInteger   byte = ':'
+	respBulk      byte = '$'
+	respArray     byte = '*'
+	respNull      byte = '_'
+	respDouble    byte = ','
+	respBoolean   byte = '#'
+	respBigNumber byte = '('
+	respVerbatim  byte = '='
+	respMap       byte = '%'
+	respSet       byte = '~'
+	respPush      byte = '>'
+)
+
+// maxBulkLength is Redis' proto-max-bulk-len default; a longer header means
+// the stream is out of sync.
+const maxBulkLength = 512 << 20
+
+// maxPreallocElems caps the capacity reserved for an aggregate up front;
+// larger ones grow as their elements arrive.
+const maxPreallocElems = 1024
+
+// respValue is one decoded reply. Which fields are meaningful depends on
+// kind: str for simple, bulk, verbatim, big number and error replies; num
+// for integers and booleans (1 or 0); float for doubles; elems for arrays,
+// sets and pushes, and for maps as alternating keys and values.
+type respValue struct {
+	kind  byte
+	str   string
+	num   int64
+	float float64
+	elems []respValue
+}
+
+func (v respValue) isNull() bool {
+	return v.kind == respNull
+}
+
+// text returns the value of a string-like reply.
+func (v respValue) text() (string, bool) {
+	switch v.kind {
+	case respSimple, respBulk, respVerbatim, respBigNumber:
+		return v.str, true
+	}
+	return "", false
+}
+
+// mapValue looks up key in a RESP3 map reply, or in the flat key/value array
+// RESP2 servers send in its place.
+func (v respValue) mapValue(key string) (respValue, bool) {
+	if v.kind != respMap && v.kind != respArray {
+		return respValue{}, false
+	}
+	for i := 0; i+1 < len(v.elems); i += 2 {
+		if k, ok := v.elems[i].text(); ok && k == key {
+			return v.elems[i+1], true
+		}
+	}
+	return respValue{}, false
+}
+
+func (v respValue) String() string {
+	switch v.kind {
+	case respNull:
+		return "(nil)"
+	case respInteger:
+		return strconv.FormatInt(v.num, 10)
+	case respBoolean:
+		return strconv.FormatBool(v.num == 1)
+	case respDouble:
+		return strconv.FormatFloat(v.float, 'g', -1, 64)
+	case respError:
+		return "(error) " + v.str
+	case respArray, respSet, respPush, respMap:
+		parts := make([]string, len(v.elems))
+		for i, e := range v.elems {
+			parts[i] = e.String()
+		}
+		return string(v.kind) + "[" + strings.Join(parts, " ") + "]"
+	}
+	return strconv.Quote(v.str)
+}
+
+// redisError is an error reply. Code is its first word, such as ERR,
+// WRONGTYPE, NOSCRIPT or WRONGPASS.
+type redisError struct {
+	Code    string
+	Message string
+}
+
+func (e *redisError) Error() string {
+	if e.Message == "" {
+		return "redis error: " + e.Code
+	}
+	return "redis error: " + e.Code + " " + e.Message
+}
+
+func newRedisError(s string) *redisError {
+	code, msg, _ := strings.Cut(s, " ")
+	return &redisError{Code: code, Message: msg}
+}
+
+// isRedisError reports whether err is an error reply with the given code.
+func isRedisError(err error, code string) bool {
+	var rerr *redisError
+	return errors.As(err, &rerr) && rerr.Code == code
+}
+
+// respProtocolError means the server sent something that is not valid RESP;
+// the connection cannot be used any further.
+type respProtocolError struct {
+	reason string
+}
+
+func (e *respProtocolError) Error() string {
+	return "redis protocol error: " + e.reason
+}
+
+func protocolErrorf(format string, args ...any) error {
+	return &respProtocolError{reason: fmt.Sprintf(format, args...)}
+}
+
+// readValue decodes one RESP2 or RESP3 value, including error replies,
+// which are returned as values of kind respError. Attributes are skipped.
+// I/O failures are reported as ioEOF.
+func readValue(r *bufio.Reader) (respValue, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return respValue{}, err
+	}
+	if line == "" {
+		return respValue{}, protocolErrorf("empty reply line")
+	}
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case respSimple, respBigNumber:
+		return respValue{kind: kind, str: rest}, nil
+	case respError:
+		return respValue{kind: respError, str: rest}, nil
+	case respNull:
+		return respValue{kind: respNull}, nil
+	case respInteger:
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return respValue{}, protocolErrorf("invalid integer %q", line)
+		}
+		return respValue{kind: respInteger, num: n}, nil
+	case respBoolean:
+		switch rest {
+		case "t":
+			return respValue{kind: respBoolean, num: 1}, nil
+		case "f":
+			return respValue{kind: respBoolean}, nil
+		}
+		return respValue{}, protocolErrorf("invalid boolean %q", line)
+	case respDouble:
+		f, err := parseRespDouble(rest)
+		if err != nil {
+			return respValue{}, protocolErrorf("invalid double %q", line)
+		}
+		return respValue{kind: respDouble, float: f}, nil
+	case respBulk, respVerbatim, '!':
+		n, err := parseLength(line)
+		if err != nil {
+			return respValue{}, err
+		}
+		if n < 0 {
+			return respValue{kind: respNull}, nil
+		}
+		s, err := readBlob(r, n)
+		if err != nil {
+			return respValue{}, err
+		}
+		switch kind {
+		case '!':
+			return respValue{kind: respError, str: s}, nil
+		case respVerbatim:
+			// Verbatim strings start with a three letter format and a colon.
+			if len(s) < 4 || s[3] != ':' {
+				return respValue{}, protocolErrorf("invalid verbatim string")
+			}
+			return respValue{kind: respVerbatim, str: s[4:]}, nil
+		}
+		return respValue{kind: respBulk, str: s}, nil
+	case respArray, respSet, respPush, respMap, '|':
+		n, err := parseLength(line)
+		if err != nil {
+			return respValue{}, err
+		}
+		if n < 0 {
+			return respValue{kind: respNull}, nil
+		}
+		count := n
+		if kind == respMap || kind == '|' {
+			count = 2 * n
+		}
+		// Trust the header only so far: a corrupt length must end in a
+		// protocol error or EOF, not a huge allocation.
+		elems := make([]respValue, 0, min(count, maxPreallocElems))
+		for i := 0; i < count; i++ {
+			e, err := readValue(r)
+			if err != nil {
+				return respValue{}, err
+			}
+			elems = append(elems, e)
+		}
+		if kind == '|' {
+			// Attributes describe the reply that follows; none are used here.
+			return readValue(r)
+		}
+		return respValue{kind: kind, elems: elems}, nil
+	}
+	return respValue{}, protocolErrorf("unknown reply type %q", line)
+}
+
+// readReply reads the reply to a command. An error reply is returned as a
+// *redisError; RESP3 push messages arriving out of band are skipped.
+func readReply(rw *bufio.ReadWriter) (respValue, error) {
+	for {
+		v, err := readValue(rw.Reader)
+		if err != nil {
+			return v, err
+		}
+		switch v.kind {
+		case respPush:
+			continue
+		case respError:
+			return v, newRedisError(v.str)
+		}
+		return v, nil
+	}
+}
+
+// redisDo sends a command and reads its reply.
+func redisDo(rw *bufio.ReadWriter, cmd string, args ...string) (respValue, error) {
+	if err := writeCommand(rw, cmd, args...); err != nil {
+		return respValue{}, err
+	}
+	return readReply(rw)
+}
+
+func parseLength(line string) (int, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < -1 || n > maxBulkLength {
+		return 0, protocolErrorf("invalid length %q", line)
+	}
+	return n, nil
+}
+
+// readBlob reads exactly n bytes and the CRLF after them.
+func readBlob(r *bufio.Reader, n int) (string, error) {
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", ioEOF
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", protocolErrorf("bulk string not terminated by CRLF")
+	}
+	return string(buf[:n]), nil
+}
+
+func parseRespDouble(s string) (float64, error) {
+	switch s {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func readTestValue(t *testing.T, payload string) respValue {
+	t.Helper()
+	v, err := readValue(bufio.NewReader(strings.NewReader(payload)))
+	if err != nil {
+		t.Fatalf("readValue(%q) error: %v", payload, err)
+	}
+	return v
+}
+
+func TestReadValueScalars(t *testing.T) {
+	for _, tc := range []struct {
+		payload string
+		want    string
+	}{
+		{"+OK\r\n", `"OK"`},
+		{":-7\r\n", "-7"},
+		{"$5\r\nhello\r\n", `"hello"`},
+		{"$0\r\n\r\n", `""`},
+		{"$-1\r\n", "(nil)"},
+		{"*-1\r\n", "(nil)"},
+		{"_\r\n", "(nil)"},
+		{",3.25\r\n", "3.25"},
+		{"#t\r\n", "true"},
+		{"#f\r\n", "false"},
+		{"(3492890328409238509324850943850943825024385\r\n", `"3492890328409238509324850943850943825024385"`},
+		{"=15\r\ntxt:Some string\r\n", `"Some string"`},
+		{"-ERR boom\r\n", "(error) ERR boom"},
+		{"!21\r\nSYNTAX invalid syntax\r\n", "(error) SYNTAX invalid syntax"},
+	} {
+		if got := readTestValue(t, tc.payload).String(); got != tc.want {
+			t.Errorf("readValue(%q) = %s, want %s", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestReadValueDoubleInfinity(t *testing.T) {
+	if v := readTestValue(t, ",-inf\r\n"); !math.IsInf(v.float, -1) {
+		t.Fatalf("expected -inf, got %v", v.float)
+	}
+}
+
+func TestReadValueAggregates(t *testing.T) {
+	v := readTestValue(t, "%2\r\n+server\r\n$5\r\nredis\r\n+proto\r\n:3\r\n")
+	if v.kind != respMap {
+		t.Fatalf("expected map, got %s", v)
+	}
+	if proto, ok := v.mapValue("proto"); !ok || proto.num != 3 {
+		t.Fatalf("unexpected proto: %s", proto)
+	}
+	if _, ok := v.mapValue("version"); ok {
+		t.Fatalf("expected no version entry")
+	}
+
+	v = readTestValue(t, "~2\r\n$1\r\na\r\n$1\r\nb\r\n")
+	got, err := stringsOf(v)
+	if err != nil || len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("unexpected set: %q %v", got, err)
+	}
+
+	v = readTestValue(t, "*2\r\n*1\r\n:1\r\n$-1\r\n")
+	if got := v.String(); got != "*[*[1] (nil)]" {
+		t.Fatalf("unexpected nested array: %s", got)
+	}
+}
+
+func TestReadValueSkipsAttributes(t *testing.T) {
+	v := readTestValue(t, "|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.19\r\n:42\r\n")
+	if v.kind != respInteger || v.num != 42 {
+		t.Fatalf("expected the reply after the attribute, got %s", v)
+	}
+}
+
+func TestReadReplySkipsPushes(t *testing.T) {
+	payload := ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n:1\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(payload)), bufio.NewWriter(io.Discard))
+	v, err := readReply(rw)
+	if err != nil || v.kind != respInteger || v.num != 1 {
+		t.Fatalf("expected the reply after the push, got %s %v", v, err)
+	}
+}
+
+func TestReadReplyErrors(t *testing.T) {
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader("-NOSCRIPT No matching script\r\n")), bufio.NewWriter(io.Discard))
+	_, err := readReply(rw)
+	var rerr *redisError
+	if !errors.As(err, &rerr) || rerr.Code != "NOSCRIPT" || rerr.Message != "No matching script" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if !isRedisError(err, "NOSCRIPT") || isRedisError(err, "ERR") {
+		t.Fatalf("isRedisError mismatch for %v", err)
+	}
+}
+
+func TestReadValueProtocolErrors(t *testing.T) {
+	for _, payload := range []string{
+		"?what\r\n",
+		":12x\r\n",
+		"#x\r\n",
+		"$abc\r\n",
+		"$3\r\nabcde\r\n",
+		"$1000000000\r\n",
+		"=3\r\nabc\r\n",
+		"\r\n",
+	} {
+		_, err := readValue(bufio.NewReader(strings.NewReader(payload)))
+		var perr *respProtocolError
+		if !errors.As(err, &perr) {
+			t.Errorf("expected protocol error for %q, got %v", payload, err)
+		}
+	}
+}
+
+func TestReadValueTruncated(t *testing.T) {
+	for _, payload := range []string{"", "$5\r\nab", "*2\r\n:1\r\n"} {
+		if _, err := readValue(bufio.NewReader(strings.NewReader(payload))); err != ioEOF {
+			t.Errorf("expected ioEOF for %q, got %v", payload, err)
+		}
+	}
+}
+
+func TestReadValueHugeAggregateHeader(t *testing.T) {
+	// A map header claiming 512M pairs with no elements behind it.
+	_, err := readValue(bufio.NewReader(strings.NewReader("%536870912\r\n:1\r\n")))
+	if err != ioEOF {
+		t.Fatalf("expected ioEOF for a truncated huge aggregate, got %v", err)
+	}
+}
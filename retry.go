@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	retrySetKey       = "retry"
+	defaultMaxRetries = 25
+	maxErrorMessage   = 10000
+)
+
+// retryJitter returns a value in [0, n); replaced in tests.
+var retryJitter = rand.Intn
+
+// failureOutcome says what happened to a job after it failed.
+type failureOutcome int
+
+const (
+	// failureDiscarded: the job has retry disabled and was dropped.
+	failureDiscarded failureOutcome = iota
+	// failureRetried: the job was added to the retry set.
+	failureRetried
+	// failureExhausted: the job used up all of its retries and was dropped.
+	failureExhausted
+	// failureDead: the job used up all of its retries and was moved to the
+	// dead set.
+	failureDead
+)
+
+// maxRetries interprets the payload's "retry" option the way Sidekiq does:
+// true (or absent) means the default of 25 and an integer is an explicit
+// limit. false disables retries entirely, reported by enabled == false.
+func maxRetries(job *sidekiqJob) (limit int, enabled bool) {
+	raw := job.Retry
+	if raw == nil {
+		return defaultMaxRetries, true
+	}
+	var asBool bool
+	if err := json.Unmarshal(raw, &asBool); err == nil {
+		if asBool {
+			return defaultMaxRetries, true
+		}
+		return 0, false
+	}
+	var asInt int
+	if err := json.Unmarshal(raw, &asInt); err == nil {
+		if asInt < 0 {
+			return 0, true
+		}
+		return asInt, true
+	}
+	return defaultMaxRetries, true
+}
+
+// retryDelay matches Sidekiq's default backoff: count**4 + 15 + rand(10)*(count+1) seconds.
+func retryDelay(count int) time.Duration {
+	seconds := count*count*count*count + 15 + retryJitter(10)*(count+1)
+	return time.Duration(seconds) * time.Second
+}
+
+// recordFailure updates the payload with Sidekiq's retry bookkeeping
+// (retry_count, error_message, error_class, failed_at/retried_at) and
+// returns the new retry count.
+func recordFailure(job *sidekiqJob, jobErr error, now time.Time) int {
+	msg := jobErr.Error()
+	if len(msg) > maxErrorMessage {
+		msg = msg[:maxErrorMessage]
+	}
+	job.set("error_message", msg)
+	job.set("error_class", errorClass(jobErr))
+
+	count := 0
+	if job.has("retry_count") {
+		_ = job.get("retry_count", &count)
+		count++
+		job.set("retried_at", epochSeconds(now))
+	} else {
+		job.set("failed_at", epochSeconds(now))
+	}
+	job.set("retry_count", count)
+
+	var retryQueue string
+	if err := job.get("retry_queue", &retryQueue); err == nil && retryQueue != "" {
+		job.Queue = retryQueue
+	}
+	return count
+}
+
+// scheduleRetry records the failure on the job and, if it still has retries
+// left, adds it to the retry set scored by its next run time.
+func scheduleRetry(rw *bufio.ReadWriter, job *sidekiqJob, jobErr error, now time.Time) (failureOutcome, error) {
+	limit, enabled := maxRetries(job)
+	if !enabled {
+		return failureDiscarded, nil
+	}
+	count := recordFailure(job, jobErr, now)
+	if count >= limit {
+		return failureExhausted, nil
+	}
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return failureDiscarded, err
+	}
+	at := now.Add(retryDelay(count))
+	if err := writeCommand(rw, "ZADD", retrySetKey, formatScore(at), string(payload)); err != nil {
+		return failureDiscarded, err
+	}
+	if _, err := readInteger(rw); err != nil {
+		return failureDiscarded, err
+	}
+	return failureRetried, nil
+}
+
+// handleJobFailure runs a failed job through the retry set and, once its
+// retries are exhausted, the dead set.
+func handleJobFailure(rw *bufio.ReadWriter, job *sidekiqJob, jobErr error, now time.Time) (failureOutcome, error) {
+	outcome, err := scheduleRetry(rw, job, jobErr, now)
+	if err != nil || outcome != failureExhausted || !sendsToMorgue(job) {
+		return outcome, err
+	}
+	if err := killJob(rw, job, now); err != nil {
+		return outcome, err
+	}
+	return failureDead, nil
+}
+
+// errorClass names the innermost error type, standing in for the Ruby
+// exception class shown in the Web UI.
+func errorClass(err error) string {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			break
+		}
+		err = next
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", err), "*")
+}
+
+// epochSeconds mirrors Ruby's Time#to_f used for Sidekiq timestamps.
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func formatScore(t time.Time) string {
+	return strconv.FormatFloat(epochSeconds(t), 'f', 6, 64)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeJob(t *testing.T, payload string) *sidekiqJob {
+	t.Helper()
+	var job sidekiqJob
+	if err := json.Unmarshal([]byte(payload), &job); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	return &job
+}
+
+func TestMaxRetries(t *testing.T) {
+	cases := []struct {
+		payload string
+		limit   int
+		enabled bool
+	}{
+		{`{"class":"RubyWorker","args":[]}`, 25, true},
+		{`{"class":"RubyWorker","args":[],"retry":true}`, 25, true},
+		{`{"class":"RubyWorker","args":[],"retry":false}`, 0, false},
+		{`{"class":"RubyWorker","args":[],"retry":3}`, 3, true},
+		{`{"class":"RubyWorker","args":[],"retry":0}`, 0, true},
+	}
+	for _, c := range cases {
+		limit, enabled := maxRetries(decodeJob(t, c.payload))
+		if limit != c.limit || enabled != c.enabled {
+			t.Fatalf("%s: expected (%d, %t), got (%d, %t)", c.payload, c.limit, c.enabled, limit, enabled)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryJitter = func(int) int { return 9 }
+	t.Cleanup(func() { retryJitter = rand.Intn })
+
+	if got := retryDelay(0); got != 24*time.Second {
+		t.Fatalf("expected 24s, got %v", got)
+	}
+	if got := retryDelay(2); got != (16+15+27)*time.Second {
+		t.Fatalf("expected 58s, got %v", got)
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	job := decodeJob(t, `{"class":"RubyWorker","args":[1],"queue":"go","retry_queue":"low"}`)
+
+	if count := recordFailure(job, errors.New("boom"), now); count != 0 {
+		t.Fatalf("expected first failure count 0, got %d", count)
+	}
+	if !job.has("failed_at") || job.has("retried_at") {
+		t.Fatalf("expected failed_at only on first failure")
+	}
+	if job.Queue != "low" {
+		t.Fatalf("expected retry_queue to override queue, got %q", job.Queue)
+	}
+
+	if count := recordFailure(job, errors.New("boom again"), now.Add(time.Minute)); count != 1 {
+		t.Fatalf("expected second failure count 1, got %d", count)
+	}
+	var msg, class string
+	_ = job.get("error_message", &msg)
+	_ = job.get("error_class", &class)
+	if msg != "boom again" || class != "errors.errorString" {
+		t.Fatalf("unexpected error fields: %q %q", msg, class)
+	}
+	if !job.has("retried_at") {
+		t.Fatalf("expected retried_at after a retry")
+	}
+}
+
+func TestScheduleRetryWritesZADD(t *testing.T) {
+	retryJitter = func(int) int { return 0 }
+	t.Cleanup(func() { retryJitter = rand.Intn })
+
+	out := bytes.NewBuffer(nil)
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(":1\r\n")), bufio.NewWriter(out))
+	job := decodeJob(t, `{"class":"RubyWorker","args":[1],"queue":"go","retry":true}`)
+
+	outcome, err := scheduleRetry(rw, job, errors.New("boom"), time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("scheduleRetry error: %v", err)
+	}
+	if outcome != failureRetried {
+		t.Fatalf("expected failureRetried, got %v", outcome)
+	}
+	cmd := out.String()
+	if !strings.Contains(cmd, "$4\r\nZADD\r\n$5\r\nretry\r\n$17\r\n1700000015.000000\r\n") {
+		t.Fatalf("unexpected command: %q", cmd)
+	}
+	if !strings.Contains(cmd, `"retry_count":0`) {
+		t.Fatalf("expected retry_count in payload: %q", cmd)
+	}
+}
+
+func TestScheduleRetryExhaustedAndDisabled(t *testing.T) {
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBuffer(nil)), bufio.NewWriter(bytes.NewBuffer(nil)))
+
+	job := decodeJob(t, `{"class":"RubyWorker","args":[1],"retry":1,"retry_count":0}`)
+	if outcome, err := scheduleRetry(rw, job, errors.New("boom"), time.Now()); err != nil || outcome != failureExhausted {
+		t.Fatalf("expected failureExhausted, got %v %v", outcome, err)
+	}
+
+	job = decodeJob(t, `{"class":"RubyWorker","args":[1],"retry":false}`)
+	if outcome, err := scheduleRetry(rw, job, errors.New("boom"), time.Now()); err != nil || outcome != failureDiscarded {
+		t.Fatalf("expected failureDiscarded, got %v %v", outcome, err)
+	}
+}
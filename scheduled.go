@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const scheduleSetKey = "schedule"
+
+// scheduledSets are polled in this order, as in Sidekiq::Scheduled::SETS.
+var scheduledSets = []string{retrySetKey, scheduleSetKey}
+
+// promoteScript removes a job from a sorted set and pushes it onto its queue
+// in one step. The ZREM result guards against two pollers promoting the same
+// job: only the one that actually removed it pushes it.
+const promoteScript = `if redis.call("zrem", KEYS[1], ARGV[1]) == 1 then
+  redis.call("sadd", KEYS[2], ARGV[3])
+  redis.call("lpush", KEYS[3], ARGV[2])
+  return 1
+end
+return 0`
+
+var promoteScriptSHA = scriptSHA(promoteScript)
+
+const defaultPollIntervalAverage = 5 * time.Second
+
+// pollRandom returns a value in [0, 1); replaced in tests.
+var pollRandom = rand.Float64
+
+type scheduledPoller struct {
+	client  *redisClient
+	average time.Duration
+	life    *lifecycle
+}
+
+// run polls until the service goes quiet; like Sidekiq's Launcher#quiet,
+// quieting stops the poller along with the processors.
+func (p scheduledPoller) run() {
+	// Like Sidekiq, wait a little before the first poll so a fleet of
+	// processes started together does not poll in lockstep.
+	if !p.life.pause(10*time.Second + time.Duration(pollRandom()*float64(5*time.Second))) {
+		return
+	}
+	for {
+		var count int
+		err := p.client.withConn(func(rw *bufio.ReadWriter) error {
+			if err := p.enqueueDue(rw, time.Now()); err != nil {
+				return err
+			}
+			var err error
+			count, err = processCount(rw)
+			return err
+		})
+		if err != nil {
+			log.Printf("[go_worker] poller error: %v; retrying in 2s", err)
+			if !p.life.pause(2 * time.Second) {
+				return
+			}
+			continue
+		}
+		if !p.life.pause(randomPollInterval(p.average, count)) {
+			return
+		}
+	}
+}
+
+// enqueueDue moves every job in the retry and schedule sets whose score is
+// at or before now onto its queue.
+func (p scheduledPoller) enqueueDue(rw *bufio.ReadWriter, now time.Time) error {
+	for _, set := range scheduledSets {
+		for {
+			if err := writeCommand(rw, "ZRANGEBYSCORE", set, "-inf", formatScore(now), "LIMIT", "0", "100"); err != nil {
+				return err
+			}
+			due, err := readStringArray(rw)
+			if err != nil {
+				return err
+			}
+			for _, payload := range due {
+				if err := promote(rw, set, payload, now); err != nil {
+					return err
+				}
+			}
+			if len(due) < 100 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// promote pushes one due job onto its queue with a fresh enqueued_at. A
+// payload that cannot be decoded is pushed unchanged onto queue:default, so
+// it is not left in the set to be retried forever.
+func promote(rw *bufio.ReadWriter, set, payload string, now time.Time) error {
+	queue := "default"
+	pushed := payload
+	var jid string
+	var job sidekiqJob
+	if err := json.Unmarshal([]byte(payload), &job); err == nil {
+		if job.Queue != "" {
+			queue = job.Queue
+		}
+		jid = job.JID
+		job.EnqueuedAt = epochSeconds(now)
+		if b, err := json.Marshal(job); err == nil {
+			pushed = string(b)
+		}
+	}
+	moved, err := evalScript(rw, promoteScript, promoteScriptSHA,
+		[]string{set, "queues", "queue:" + queue},
+		payload, pushed, queue)
+	if err != nil {
+		return err
+	}
+	if moved == 1 {
+		log.Printf("[go_worker] enqueued due job from=%s queue=%s jid=%s", set, queue, jid)
+	}
+	return nil
+}
+
+// evalScript runs a Lua script by SHA, loading it with EVAL on NOSCRIPT.
+func evalScript(rw *bufio.ReadWriter, script, sha string, keys []string, args ...string) (int64, error) {
+	params := append([]string{sha, strconv.Itoa(len(keys))}, keys...)
+	params = append(params, args...)
+	if err := writeCommand(rw, "EVALSHA", params...); err != nil {
+		return 0, err
+	}
+	n, err := readInteger(rw)
+	if !isRedisError(err, "NOSCRIPT") {
+		return n, err
+	}
+	params[0] = script
+	if err := writeCommand(rw, "EVAL", params...); err != nil {
+		return 0, err
+	}
+	return readInteger(rw)
+}
+
+func scriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// processCount is the number of Sidekiq processes (Ruby and Go) registered
+// in the processes set, never less than one.
+func processCount(rw *bufio.ReadWriter) (int, error) {
+	if err := writeCommand(rw, "SCARD", processesKey); err != nil {
+		return 0, err
+	}
+	n, err := readInteger(rw)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		n = 1
+	}
+	return int(n), nil
+}
+
+// randomPollInterval follows Sidekiq's scaled poll interval: the average is
+// multiplied by the process count so the cluster as a whole polls about once
+// per average interval. Small clusters get ±50% jitter around it.
+func randomPollInterval(average time.Duration, processes int) time.Duration {
+	interval := float64(average) * float64(processes)
+	if processes < 10 {
+		return time.Duration(interval*pollRandom() + interval/2)
+	}
+	return time.Duration(interval * pollRandom())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRandomPollInterval(t *testing.T) {
+	pollRandom = func() float64 { return 0.5 }
+	t.Cleanup(func() { pollRandom = rand.Float64 })
+
+	if got := randomPollInterval(5*time.Second, 1); got != 5*time.Second {
+		t.Fatalf("expected 5s for a single process, got %v", got)
+	}
+	if got := randomPollInterval(5*time.Second, 3); got != 15*time.Second {
+		t.Fatalf("expected 15s for three processes, got %v", got)
+	}
+	if got := randomPollInterval(5*time.Second, 10); got != 25*time.Second {
+		t.Fatalf("expected 25s for ten processes, got %v", got)
+	}
+}
+
+func TestScriptSHA(t *testing.T) {
+	if got := scriptSHA("return 1"); got != "e0e1f9fabfc9d4800c877a703b823ac0578ff8db" {
+		t.Fatalf("unexpected sha: %s", got)
+	}
+}
+
+func TestPromoteFallsBackToEvalOnNoScript(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	replies := "-NOSCRIPT No matching script.\r\n:1\r\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out))
+
+	payload := `{"class":"RubyWorker","args":[5],"queue":"go"}`
+	if err := promote(rw, "schedule", payload, time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("promote error: %v", err)
+	}
+	cmd := out.String()
+	if !strings.Contains(cmd, "EVALSHA") || !strings.Contains(cmd, "$4\r\nEVAL\r\n") {
+		t.Fatalf("expected EVALSHA then EVAL: %q", cmd)
+	}
+	for _, want := range []string{"$8\r\nschedule\r\n", "$6\r\nqueues\r\n", "$8\r\nqueue:go\r\n", `"enqueued_at":1700000000`} {
+		if !strings.Contains(cmd, want) {
+			t.Fatalf("expected %q in %q", want, cmd)
+		}
+	}
+}
+
+func TestEnqueueDuePollsRetryThenSchedule(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString("*0\r\n*0\r\n")), bufio.NewWriter(out))
+
+	if err := (scheduledPoller{}).enqueueDue(rw, time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("enqueueDue error: %v", err)
+	}
+	cmd := out.String()
+	retry := strings.Index(cmd, "$5\r\nretry\r\n")
+	schedule := strings.Index(cmd, "$8\r\nschedule\r\n")
+	if retry < 0 || schedule < 0 || retry > schedule {
+		t.Fatalf("expected retry then schedule polls: %q", cmd)
+	}
+}
+
+func TestScheduledPollerStopsWhenQuiet(t *testing.T) {
+	life := newLifecycle()
+	done := make(chan struct{})
+	go func() {
+		scheduledPoller{average: time.Second, life: life}.run()
+		close(done)
+	}()
+	life.quiet()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the poller to stop once the service is quiet")
+	}
+}
@@ -2,144 +2,308 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
-	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-func processTestRun(db *sql.DB, testRunID int64) error {
-	if !existsTestRun(db, testRunID) {
+func processTestRun(ctx context.Context, db *sql.DB, testRunID int64) error {
+	release, err := acquireMeasurement(ctx)
+	if err != nil {
+		return fmt.Errorf("waiting for serial measurement: %w", err)
+	}
+	defer release()
+
+	exists, err := existsTestRun(ctx, db, testRunID)
+	if err != nil {
+		return fmt.Errorf("lookup test_run failed: %w", err)
+	}
+	if !exists {
 		return fmt.Errorf("test_runs id %d not found", testRunID)
 	}
-	page, perPage, err := fetchTaskWindow(db, testRunID)
+	page, perPage, err := fetchTaskWindow(ctx, db, testRunID)
 	if err != nil {
 		return fmt.Errorf("fetch task window failed: %w", err)
 	}
 
-	values, err := fetchSamples(db, page, perPage)
+	values, err := fetchSamples(ctx, db, page, perPage)
 	if err != nil {
 		return fmt.Errorf("fetch samples failed: %w", err)
 	}
+	var statsErr error
 	stats, elapsed, peak := measurePeakResidentMemory(func() (Stats, float64) {
 		start := time.Now()
-		stats := calculateStatistics(values)
+		var stats Stats
+		stats, statsErr = calculateStatisticsContext(ctx, values)
 		return stats, time.Since(start).Seconds()
 	})
+	if statsErr != nil {
+		return fmt.Errorf("calculate statistics failed: %w", statsErr)
+	}
 
-	if err := insertTestResult(db, testRunID, stats, elapsed, peak); err != nil {
+	if err := insertTestResult(ctx, db, testRunID, stats, elapsed, peak); err != nil {
 		return fmt.Errorf("insert test_result failed: %w", err)
 	}
-	log.Printf("processed test_run=%d duration=%.6fs memory_bytes=%.0f\n", testRunID, elapsed, peak)
+	log.Printf("processed test_run=%d jid=%s duration=%.6fs memory_bytes=%.0f\n", testRunID, jidFrom(ctx), elapsed, peak)
 	return nil
 }
 
-func runService(db *sql.DB) {
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379/0"
+// testRunJob handles RubyWorker/GoWorker jobs, whose first argument is the
+// test_runs id to compute results for. ActiveJob callers may pass the
+// TestRun record itself, which arrives as its GlobalID. With advisory set,
+// the run holds a Postgres advisory lock on the test_run_id, and a job whose
+// test run is already being processed elsewhere is skipped as a duplicate.
+func testRunJob(db *sql.DB, advisory bool) jobHandler {
+	return func(ctx context.Context, job *sidekiqJob) error {
+		var id int64
+		if len(job.Args) > 0 {
+			id, _ = parseInt64(job.Args[0])
+			var gid string
+			if json.Unmarshal(job.Args[0], &gid) == nil {
+				if model, gidID, ok := parseGlobalID(gid); ok && model == "TestRun" {
+					id, _ = strconv.ParseInt(gidID, 10, 64)
+				}
+			}
+		}
+		if id == 0 {
+			return fmt.Errorf("%w: missing test_run_id", errBadArgs)
+		}
+		if !advisory {
+			return processTestRun(ctx, db, id)
+		}
+		locked, err := withAdvisoryLock(ctx, db, id, func() error {
+			return processTestRun(ctx, db, id)
+		})
+		if err == nil && !locked {
+			return fmt.Errorf("%w: test_run %d is locked by another worker", errDuplicateJob, id)
+		}
+		return err
 	}
-	u, err := url.Parse(redisURL)
+}
+
+// serviceOptions carries service settings given on the command line; zero
+// values fall back to the environment.
+type serviceOptions struct {
+	Concurrency       int
+	SerialMeasurement bool
+}
+
+func runService(db *sql.DB, opts serviceOptions) {
+	redisCfg, err := redisConfigFromEnv()
 	if err != nil {
-		log.Fatalf("invalid REDIS_URL: %v", err)
+		log.Fatal(err)
 	}
-	host := u.Host
-	if host == "" && u.Scheme == "unix" {
-		log.Fatal("unix sockets not supported by this worker")
+	queues, err := parseQueueList(os.Getenv("WORKER_QUEUE"))
+	if err != nil {
+		log.Fatalf("invalid WORKER_QUEUE: %v", err)
 	}
-	password, _ := u.User.Password()
-	dbIndex := 0
-	if parts := strings.TrimPrefix(u.Path, "/"); parts != "" {
-		if i, err := strconv.Atoi(parts); err == nil {
-			dbIndex = i
+	poolSize := defaultRedisPoolSize
+	if v := os.Getenv("WORKER_REDIS_POOL_SIZE"); v != "" {
+		poolSize, err = strconv.Atoi(v)
+		if err != nil || poolSize < 1 {
+			log.Fatalf("invalid WORKER_REDIS_POOL_SIZE: %q", v)
 		}
 	}
-	qname := os.Getenv("WORKER_QUEUE")
-	if qname == "" {
-		qname = "default"
+	idleTimeout := defaultRedisIdleTimeout
+	if v := os.Getenv("WORKER_REDIS_IDLE_TIMEOUT"); v != "" {
+		idleTimeout, err = parseSeconds(v)
+		if err != nil {
+			log.Fatalf("invalid WORKER_REDIS_IDLE_TIMEOUT: %q", v)
+		}
 	}
-	queue := "queue:" + qname
-
-	log.Printf("[go_worker] starting service redis=%s queue=%s", redisURL, queue)
+	client := newRedisClient(redisCfg, poolSize, idleTimeout)
+	defer client.close()
+	reliable, _ := strconv.ParseBool(os.Getenv("WORKER_RELIABLE_FETCH"))
+	identity := processIdentity()
 
-	for {
-		conn, err := net.DialTimeout("tcp", host, 5*time.Second)
-		if err != nil {
-			log.Printf("redis connect failed: %v; retrying in 2s", err)
-			time.Sleep(2 * time.Second)
-			continue
+	pollInterval := defaultPollIntervalAverage
+	if v := os.Getenv("WORKER_SCHEDULED_POLL_INTERVAL"); v != "" {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil || secs < 0 {
+			log.Fatalf("invalid WORKER_SCHEDULED_POLL_INTERVAL: %q", v)
 		}
-		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-
-		if password != "" {
-			if err := writeCommand(rw, "AUTH", password); err != nil || readOK(rw) != nil {
-				log.Printf("redis auth failed: %v", err)
-				conn.Close()
-				time.Sleep(2 * time.Second)
-				continue
+		pollInterval = time.Duration(secs * float64(time.Second))
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency == 0 {
+		concurrency = 1
+		if v := os.Getenv("WORKER_CONCURRENCY"); v != "" {
+			concurrency, err = strconv.Atoi(v)
+			if err != nil {
+				log.Fatalf("invalid WORKER_CONCURRENCY: %q", v)
 			}
 		}
-		if dbIndex != 0 {
-			if err := writeCommand(rw, "SELECT", strconv.Itoa(dbIndex)); err != nil || readOK(rw) != nil {
-				log.Printf("redis select failed: %v", err)
-				conn.Close()
-				time.Sleep(2 * time.Second)
-				continue
-			}
+	}
+	if concurrency < 1 {
+		log.Fatalf("concurrency must be at least 1, got %d", concurrency)
+	}
+	if !opts.SerialMeasurement {
+		opts.SerialMeasurement, _ = strconv.ParseBool(os.Getenv("WORKER_SERIAL_MEASUREMENT"))
+	}
+	serializeMeasurements = opts.SerialMeasurement
+	db.SetMaxIdleConns(concurrency)
+
+	shutdownTimeout := defaultShutdownTimeout
+	if v := os.Getenv("WORKER_SHUTDOWN_TIMEOUT"); v != "" {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil || secs < 0 {
+			log.Fatalf("invalid WORKER_SHUTDOWN_TIMEOUT: %q", v)
 		}
+		shutdownTimeout = time.Duration(secs * float64(time.Second))
+	}
 
-		log.Printf("[go_worker] connected redis_host=%s db=%d listening=%s", host, dbIndex, queue)
-		lastHeartbeat := time.Now()
+	fallback := os.Getenv("WORKER_FALLBACK_QUEUE")
+	for _, name := range queues.names {
+		if fallback != "" && name == fallback {
+			log.Fatalf("WORKER_FALLBACK_QUEUE %q must not be one of the queues this worker listens on", fallback)
+		}
+	}
+	unknown, err := parseUnknownClassPolicy(os.Getenv("WORKER_UNKNOWN_CLASS"), fallback)
+	if err != nil {
+		log.Fatalf("invalid WORKER_UNKNOWN_CLASS: %v", err)
+	}
 
-		for {
-			if err := writeCommand(rw, "BRPOP", queue, "5"); err != nil {
-				log.Printf("redis write error: %v", err)
-				break
-			}
-			key, payload, err := readBRPOP(rw)
-			if err != nil {
-				if err != ioEOF {
-					log.Printf("redis read error: %v", err)
-				}
-				break
-			}
-			if key == "" && payload == "" {
-				if time.Since(lastHeartbeat) >= 60*time.Second {
-					log.Printf("[go_worker] idle (no jobs) queue=%s", queue)
-					lastHeartbeat = time.Now()
-				}
-				continue // timeout
-			}
-			lastHeartbeat = time.Now()
-			var job sidekiqJob
-			if err := json.Unmarshal([]byte(payload), &job); err != nil {
-				log.Printf("invalid job json: %v", err)
-				continue
-			}
-			if job.Class != "RubyWorker" && job.Class != "GoWorker" {
-				log.Printf("skipping job class=%s", job.Class)
-				continue
-			}
-			var id int64
-			if len(job.Args) > 0 {
-				id, _ = parseInt64(job.Args[0])
-			}
-			if id == 0 {
-				log.Printf("job missing test_run_id: %s", payload)
-				continue
+	unique, err := parseUniqueConfig(os.Getenv("WORKER_UNIQUE_JOBS"), os.Getenv("WORKER_UNIQUE_TTL"))
+	if err != nil {
+		log.Fatalf("invalid WORKER_UNIQUE_JOBS/WORKER_UNIQUE_TTL: %v", err)
+	}
+	advisory, _ := strconv.ParseBool(os.Getenv("WORKER_ADVISORY_LOCK"))
+
+	jobs := newRegistry()
+	jobs.register("RubyWorker", testRunJob(db, advisory))
+	jobs.register("GoWorker", testRunJob(db, advisory))
+
+	timeouts, err := parseJobTimeouts(os.Getenv("WORKER_JOB_TIMEOUT"), os.Getenv("WORKER_JOB_TIMEOUTS"))
+	if err != nil {
+		log.Fatalf("invalid WORKER_JOB_TIMEOUT/WORKER_JOB_TIMEOUTS: %v", err)
+	}
+
+	counters := &jobCounters{}
+	middleware, err := parseMiddleware(os.Getenv("WORKER_MIDDLEWARE"), builtinMiddleware(counters, unique))
+	if err != nil {
+		log.Fatalf("invalid WORKER_MIDDLEWARE: %v", err)
+	}
+	if (os.Getenv("WORKER_UNIQUE_JOBS") != "" || os.Getenv("WORKER_UNIQUE_TTL") != "") && middleware.index("unique") < 0 {
+		log.Fatalf("WORKER_UNIQUE_JOBS/WORKER_UNIQUE_TTL are set but WORKER_MIDDLEWARE does not include unique")
+	}
+
+	quarantineList := quarantineKey()
+
+	var fetch fetcher = basicFetch{queues: queues}
+	if reliable {
+		fetch = reliableFetch{queues: queues, identity: identity}
+	}
+
+	log.Printf("[go_worker] starting service redis=%s queues=%s strict=%t reliable_fetch=%t concurrency=%d serial_measurement=%t classes=%s middleware=%s job_timeout=%s unknown_class=%s quarantine=%s identity=%s",
+		redisCfg.URL, queues, queues.strict, reliable, concurrency, opts.SerialMeasurement, strings.Join(jobs.classes(), ","), strings.Join(middleware.names(), ","), timeouts.fallback, unknown, quarantineList, identity)
+
+	// Buffered for the OS signals and the Web UI signals the heartbeat relays.
+	signals := make(chan os.Signal, 2)
+
+	life := newLifecycle()
+	running := newWorkState()
+	beat := heartbeat{
+		client:   client,
+		identity: identity,
+		info:     newProcessInfo(identity, queues, concurrency, time.Now()),
+		work:     running,
+		stats:    counters,
+		life:     life,
+		signals:  signals,
+		reliable: reliable,
+	}
+	beatDone := make(chan struct{})
+	go func() {
+		defer close(beatDone)
+		beat.run()
+	}()
+
+	pollerDone := make(chan struct{})
+	go func() {
+		defer close(pollerDone)
+		if pollInterval > 0 {
+			scheduledPoller{client: client, average: pollInterval, life: life}.run()
+		}
+	}()
+
+	if rf, ok := fetch.(reliableFetch); ok {
+		recoverOnStartup(client, rf, identity)
+	}
+
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGTSTP)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		p := &processor{
+			registry:      jobs,
+			unknown:       unknown,
+			fallback:      fallback,
+			quarantineKey: quarantineList,
+			client:        client,
+			fetch:         fetch,
+			queues:        queues,
+			running:       running,
+			middleware:    middleware,
+			timeouts:      timeouts,
+			unique:        unique,
+			life:          life,
+			tid:           newTID(),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.run()
+		}()
+	}
+
+	for sig := range signals {
+		if sig == syscall.SIGTSTP {
+			log.Printf("[go_worker] received %v, quieting: no new jobs will be fetched", sig)
+			life.quiet()
+			continue
+		}
+		log.Printf("[go_worker] received %v, shutting down (timeout %s)", sig, shutdownTimeout)
+		break
+	}
+	signal.Stop(signals)
+	life.stop()
+
+	drain(&wg, shutdownTimeout, life, client, fetch, running)
+	<-pollerDone
+	<-beatDone
+	clearHeartbeat(client, beat)
+	log.Printf("[go_worker] stopped")
+}
+
+// recoverOnStartup registers this process' working lists and pushes jobs
+// orphaned by dead processes back onto their queues, retrying until Redis
+// is reachable.
+func recoverOnStartup(client *redisClient, rf reliableFetch, identity string) {
+	for {
+		err := client.withConn(func(rw *bufio.ReadWriter) error {
+			if err := rf.register(rw); err != nil {
+				return err
 			}
-			log.Printf("[go_worker] popped key=%s job_queue=%s class=%s test_run_id=%d", key, job.Queue, job.Class, id)
-			if err := processTestRun(db, id); err != nil {
-				log.Printf("[go_worker] process error key=%s class=%s test_run_id=%d err=%v", key, job.Class, id, err)
+			n, err := recoverOrphanedWork(rw, identity)
+			if err == nil && n > 0 {
+				log.Printf("[go_worker] recovered %d orphaned jobs", n)
 			}
+			return err
+		})
+		if err == nil {
+			return
 		}
-		conn.Close()
-		time.Sleep(1 * time.Second)
+		log.Printf("[go_worker] recovery sweep error: %v; retrying in 2s", err)
+		time.Sleep(2 * time.Second)
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "math"
     "sort"
 )
@@ -16,11 +17,21 @@ type Stats struct {
 }
 
 func calculateStatistics(samples []float64) Stats {
+    stats, _ := calculateStatisticsContext(context.Background(), samples)
+    return stats
+}
+
+// calculateStatisticsContext is calculateStatistics that gives up with the
+// context's error once it is cancelled, checked between passes over the data.
+func calculateStatisticsContext(ctx context.Context, samples []float64) (Stats, error) {
     if len(samples) == 0 {
-        return Stats{}
+        return Stats{}, ctx.Err()
     }
     s := append([]float64(nil), samples...)
     sort.Float64s(s)
+    if err := ctx.Err(); err != nil {
+        return Stats{}, err
+    }
     n := len(s)
     min := s[0]
     max := s[n-1]
@@ -30,6 +41,9 @@ func calculateStatistics(samples []float64) Stats {
         mean += v
     }
     mean /= float64(n)
+    if err := ctx.Err(); err != nil {
+        return Stats{}, err
+    }
 
     var median float64
     if n%2 == 1 {
@@ -59,6 +73,6 @@ func calculateStatistics(samples []float64) Stats {
     variance := sumsq / float64(n)
     stddev := math.Sqrt(variance)
 
-    return Stats{Min: min, Max: max, Mean: mean, Median: median, Q1: q1, Q3: q3, StdDev: stddev}
+    return Stats{Min: min, Max: max, Mean: mean, Median: median, Q1: q1, Q3: q3, StdDev: stddev}, nil
 }
 
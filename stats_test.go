@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"math"
 	"testing"
 )
@@ -51,3 +52,11 @@ func TestCalculateStatisticsEmpty(t *testing.T) {
 		t.Fatalf("expected zero-value stats, got %#v", stats)
 	}
 }
+
+func TestCalculateStatisticsContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := calculateStatisticsContext(ctx, []float64{3, 1, 2}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobTimeouts is the execution time limit per job class; zero means no limit.
+type jobTimeouts struct {
+	fallback time.Duration
+	classes  map[string]time.Duration
+}
+
+// parseJobTimeouts reads the default limit in seconds and per-class
+// overrides given as "Class=seconds,Other=seconds".
+func parseJobTimeouts(def, overrides string) (jobTimeouts, error) {
+	t := jobTimeouts{classes: map[string]time.Duration{}}
+	if def != "" {
+		d, err := parseSeconds(def)
+		if err != nil {
+			return t, err
+		}
+		t.fallback = d
+	}
+	for _, entry := range strings.Split(overrides, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		class, secs, ok := strings.Cut(entry, "=")
+		class = strings.TrimSpace(class)
+		if !ok || class == "" {
+			return t, fmt.Errorf("invalid timeout override %q (want Class=seconds)", entry)
+		}
+		d, err := parseSeconds(secs)
+		if err != nil {
+			return t, fmt.Errorf("%s: %w", class, err)
+		}
+		t.classes[class] = d
+	}
+	return t, nil
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("invalid seconds %q", s)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+func (t jobTimeouts) forClass(class string) time.Duration {
+	if d, ok := t.classes[class]; ok {
+		return d
+	}
+	return t.fallback
+}
+
+// jobTimeoutError fails a job that ran past its time limit. It matches
+// context.DeadlineExceeded with errors.Is but keeps its own error_class.
+type jobTimeoutError struct {
+	class   string
+	timeout time.Duration
+	err     error
+}
+
+func (e *jobTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s: %v", e.class, e.timeout, e.err)
+}
+
+func (e *jobTimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseJobTimeouts(t *testing.T) {
+	timeouts, err := parseJobTimeouts("30", "RubyWorker=120, GoWorker=0.5")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	cases := map[string]time.Duration{
+		"RubyWorker": 120 * time.Second,
+		"GoWorker":   500 * time.Millisecond,
+		"Other":      30 * time.Second,
+	}
+	for class, want := range cases {
+		if got := timeouts.forClass(class); got != want {
+			t.Fatalf("%s: got %s, want %s", class, got, want)
+		}
+	}
+
+	none, err := parseJobTimeouts("", "")
+	if err != nil || none.forClass("RubyWorker") != 0 {
+		t.Fatalf("expected no limit by default, got %s %v", none.forClass("RubyWorker"), err)
+	}
+	for _, bad := range [][2]string{{"-1", ""}, {"x", ""}, {"", "RubyWorker"}, {"", "=5"}, {"", "RubyWorker=soon"}} {
+		if _, err := parseJobTimeouts(bad[0], bad[1]); err == nil {
+			t.Fatalf("expected error for %q %q", bad[0], bad[1])
+		}
+	}
+}
+
+func TestJobTimeoutErrorIsDeadlineExceeded(t *testing.T) {
+	err := &jobTimeoutError{class: "RubyWorker", timeout: time.Second, err: errors.New("pq: canceling statement due to user request")}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout to match context.DeadlineExceeded")
+	}
+	if errorClass(err) != "main.jobTimeoutError" {
+		t.Fatalf("unexpected error class %s", errorClass(err))
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uniqueStrategy says how long a job's uniqueness lock is held. The names
+// match the "lock" option of sidekiq-unique-jobs.
+type uniqueStrategy string
+
+const (
+	// uniqueUntilExecuting: taken at enqueue, released when the job starts.
+	uniqueUntilExecuting uniqueStrategy = "until_executing"
+	// uniqueUntilExecuted: taken at enqueue (or when the job starts, for
+	// jobs enqueued without it), released once the job has succeeded.
+	uniqueUntilExecuted uniqueStrategy = "until_executed"
+	// uniqueWhileExecuting: taken when the job starts, released when it ends.
+	uniqueWhileExecuting uniqueStrategy = "while_executing"
+)
+
+const (
+	uniqueKeyPrefix  = "go_worker:unique:"
+	defaultUniqueTTL = time.Hour
+)
+
+// errDuplicateJob marks a job skipped because an identical one holds its
+// uniqueness lock. Such jobs are acknowledged without being retried.
+var errDuplicateJob = errors.New("duplicate job")
+
+// releaseLockScript deletes a lock only if it still holds our value, so a
+// lock that expired and was taken by another job is left alone.
+const releaseLockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then
+  return redis.call("del", KEYS[1])
+end
+return 0`
+
+var releaseLockScriptSHA = scriptSHA(releaseLockScript)
+
+func parseUniqueStrategy(s string) (uniqueStrategy, error) {
+	switch u := uniqueStrategy(s); u {
+	case uniqueUntilExecuting, uniqueUntilExecuted, uniqueWhileExecuting:
+		return u, nil
+	}
+	return "", fmt.Errorf("unknown unique strategy %q (want until_executing, until_executed or while_executing)", s)
+}
+
+// uniqueConfig is the per-class uniqueness configured on this worker. A
+// job's own "lock" option takes precedence.
+type uniqueConfig struct {
+	classes map[string]uniqueStrategy
+	ttl     time.Duration
+}
+
+// parseUniqueConfig reads "Class=strategy,Other=strategy" and the lock TTL
+// in seconds. Only until_executed and while_executing are accepted.
+func parseUniqueConfig(spec, ttl string) (uniqueConfig, error) {
+	cfg := uniqueConfig{classes: map[string]uniqueStrategy{}, ttl: defaultUniqueTTL}
+	if ttl != "" {
+		d, err := parseSeconds(ttl)
+		if err != nil || d == 0 {
+			return cfg, fmt.Errorf("invalid lock ttl %q", ttl)
+		}
+		cfg.ttl = d
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		class, name, ok := strings.Cut(entry, "=")
+		class = strings.TrimSpace(class)
+		if !ok || class == "" {
+			return cfg, fmt.Errorf("invalid unique entry %q (want Class=strategy)", entry)
+		}
+		strategy, err := parseUniqueStrategy(strings.TrimSpace(name))
+		if err != nil {
+			return cfg, err
+		}
+		// until_executing only means something to the enqueuer; a worker
+		// would release a lock nobody took.
+		if strategy == uniqueUntilExecuting {
+			return cfg, fmt.Errorf("unique entry %q: until_executing is set when enqueuing, not on the worker", entry)
+		}
+		cfg.classes[class] = strategy
+	}
+	return cfg, nil
+}
+
+// lockFor returns the strategy and TTL for a job, or "" when it is not
+// unique. Payload "lock" and "lock_ttl" (seconds) override the config.
+func (c uniqueConfig) lockFor(job *sidekiqJob) (uniqueStrategy, time.Duration) {
+	strategy := c.classes[job.Class]
+	var name string
+	if err := job.get("lock", &name); err == nil && name != "" {
+		s, err := parseUniqueStrategy(name)
+		if err != nil {
+			log.Printf("[go_worker] ignoring lock option jid=%s: %v", job.JID, err)
+		} else {
+			strategy = s
+		}
+	}
+	ttl := c.ttl
+	if ttl == 0 {
+		ttl = defaultUniqueTTL
+	}
+	var secs float64
+	if err := job.get("lock_ttl", &secs); err == nil && secs > 0 {
+		ttl = time.Duration(secs * float64(time.Second))
+	}
+	return strategy, ttl
+}
+
+// uniqueKey identifies a job by class and arguments.
+func uniqueKey(job *sidekiqJob) string {
+	args, _ := json.Marshal(job.Args)
+	sum := sha1.Sum([]byte(job.Class + ":" + string(args)))
+	return uniqueKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// acquireLock takes the lock with SET NX PX. A lock already holding jid
+// counts as acquired, so a job locked at enqueue can claim it when it runs.
+func acquireLock(rw *bufio.ReadWriter, key, jid string, ttl time.Duration) (bool, error) {
+	if err := writeCommand(rw, "SET", key, jid, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		return false, err
+	}
+	ok, err := readOptionalOK(rw)
+	if err != nil || ok {
+		return ok, err
+	}
+	if err := writeCommand(rw, "GET", key); err != nil {
+		return false, err
+	}
+	owner, err := readBulkString(rw.Reader)
+	return owner == jid, err
+}
+
+func releaseLock(rw *bufio.ReadWriter, key, jid string) error {
+	_, err := evalScript(rw, releaseLockScript, releaseLockScriptSHA, []string{key}, jid)
+	return err
+}
+
+// releaseAfterFailure drops the until_executed lock of a failed job that
+// will not run again because it was discarded or sent to the dead set.
+func (c uniqueConfig) releaseAfterFailure(rw *bufio.ReadWriter, job *sidekiqJob) error {
+	if strategy, _ := c.lockFor(job); strategy != uniqueUntilExecuted {
+		return nil
+	}
+	return releaseLock(rw, uniqueKey(job), job.JID)
+}
+
+type redisKey struct{}
+
+// withRedis hands middleware the processor's Redis connection. The
+// processor is blocked running the job, so the connection is free to use.
+func withRedis(ctx context.Context, rw *bufio.ReadWriter) context.Context {
+	return context.WithValue(ctx, redisKey{}, rw)
+}
+
+func redisFrom(ctx context.Context) *bufio.ReadWriter {
+	rw, _ := ctx.Value(redisKey{}).(*bufio.ReadWriter)
+	return rw
+}
+
+// uniqueMiddleware enforces the job's uniqueness strategy. A job whose lock
+// is held by another jid fails with errDuplicateJob without running.
+func uniqueMiddleware(cfg uniqueConfig) serverMiddleware {
+	return func(ctx context.Context, job *sidekiqJob, queue string, next jobHandler) error {
+		strategy, ttl := cfg.lockFor(job)
+		rw := redisFrom(ctx)
+		if strategy == "" || rw == nil {
+			return next(ctx, job)
+		}
+		key := uniqueKey(job)
+		switch strategy {
+		case uniqueUntilExecuting:
+			if err := releaseLock(rw, key, job.JID); err != nil {
+				return err
+			}
+			return next(ctx, job)
+		case uniqueUntilExecuted:
+			ok, err := acquireLock(rw, key, job.JID, ttl)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("%w: %s lock %s held by another job", errDuplicateJob, strategy, key)
+			}
+			if err := next(ctx, job); err != nil {
+				// Keep the lock while the job waits for its retry; the
+				// processor releases it if the failure turns out to be final.
+				// Bad arguments are quarantined and duplicates acknowledged,
+				// so neither is ever retried.
+				if errors.Is(err, errBadArgs) || errors.Is(err, errDuplicateJob) {
+					if rerr := releaseLock(rw, key, job.JID); rerr != nil {
+						log.Printf("[go_worker] could not release lock %s jid=%s: %v", key, job.JID, rerr)
+					}
+				}
+				return err
+			}
+			return releaseLock(rw, key, job.JID)
+		default:
+			ok, err := acquireLock(rw, key, job.JID, ttl)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("%w: %s lock %s held by another job", errDuplicateJob, strategy, key)
+			}
+			err = next(ctx, job)
+			if rerr := releaseLock(rw, key, job.JID); rerr != nil && err == nil {
+				err = rerr
+			}
+			return err
+		}
+	}
+}
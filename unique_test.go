@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeRedis(replies string) (*bufio.ReadWriter, *bytes.Buffer) {
+	out := bytes.NewBuffer(nil)
+	return bufio.NewReadWriter(bufio.NewReader(bytes.NewBufferString(replies)), bufio.NewWriter(out)), out
+}
+
+func TestParseUniqueConfig(t *testing.T) {
+	cfg, err := parseUniqueConfig("RubyWorker=until_executed, GoWorker=while_executing", "90")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if cfg.classes["RubyWorker"] != uniqueUntilExecuted || cfg.classes["GoWorker"] != uniqueWhileExecuting || cfg.ttl != 90*time.Second {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	for _, bad := range [][2]string{{"RubyWorker=forever", ""}, {"RubyWorker=until_executing", ""}, {"RubyWorker", ""}, {"", "0"}, {"", "soon"}} {
+		if _, err := parseUniqueConfig(bad[0], bad[1]); err == nil {
+			t.Fatalf("expected error for %q %q", bad[0], bad[1])
+		}
+	}
+}
+
+func TestUniqueLockForPayloadOverrides(t *testing.T) {
+	cfg, _ := parseUniqueConfig("RubyWorker=while_executing", "")
+	job := decodeJob(t, `{"class":"RubyWorker","args":[1],"lock":"until_executed","lock_ttl":30}`)
+	strategy, ttl := cfg.lockFor(job)
+	if strategy != uniqueUntilExecuted || ttl != 30*time.Second {
+		t.Fatalf("unexpected lock: %s %s", strategy, ttl)
+	}
+	strategy, ttl = cfg.lockFor(decodeJob(t, `{"class":"GoWorker","args":[1]}`))
+	if strategy != "" || ttl != defaultUniqueTTL {
+		t.Fatalf("expected no lock, got %s %s", strategy, ttl)
+	}
+}
+
+func TestUniqueKeyUsesClassAndArgs(t *testing.T) {
+	a := uniqueKey(decodeJob(t, `{"class":"RubyWorker","args":[1],"jid":"a"}`))
+	b := uniqueKey(decodeJob(t, `{"class":"RubyWorker","args":[ 1 ],"jid":"b"}`))
+	c := uniqueKey(decodeJob(t, `{"class":"GoWorker","args":[1],"jid":"a"}`))
+	if a != b || a == c || !strings.HasPrefix(a, uniqueKeyPrefix) {
+		t.Fatalf("unexpected keys: %s %s %s", a, b, c)
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	rw, out := fakeRedis("+OK\r\n")
+	if ok, err := acquireLock(rw, "k", "jid1", 1500*time.Millisecond); err != nil || !ok {
+		t.Fatalf("expected lock, got %t %v", ok, err)
+	}
+	if !strings.Contains(out.String(), "$2\r\nNX\r\n$2\r\nPX\r\n$4\r\n1500\r\n") {
+		t.Fatalf("expected SET NX PX: %q", out.String())
+	}
+
+	rw, _ = fakeRedis("$-1\r\n$4\r\njid1\r\n")
+	if ok, err := acquireLock(rw, "k", "jid1", time.Second); err != nil || !ok {
+		t.Fatalf("expected a lock held by the same jid to count, got %t %v", ok, err)
+	}
+	rw, _ = fakeRedis("$-1\r\n$4\r\njid2\r\n")
+	if ok, err := acquireLock(rw, "k", "jid1", time.Second); err != nil || ok {
+		t.Fatalf("expected lock held by another jid to fail, got %t %v", ok, err)
+	}
+}
+
+func TestUniqueMiddlewareSkipsDuplicates(t *testing.T) {
+	cfg, _ := parseUniqueConfig("RubyWorker=while_executing", "")
+	rw, _ := fakeRedis("$-1\r\n$5\r\nother\r\n")
+	ran := false
+	err := uniqueMiddleware(cfg)(withRedis(context.Background(), rw), decodeJob(t, `{"class":"RubyWorker","args":[1],"jid":"mine"}`), "queue:go", func(ctx context.Context, job *sidekiqJob) error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, errDuplicateJob) || ran {
+		t.Fatalf("expected duplicate to be skipped, got %v (ran=%t)", err, ran)
+	}
+}
+
+func TestUniqueMiddlewareReleasesLocks(t *testing.T) {
+	boom := errors.New("boom")
+	cases := []struct {
+		strategy    string
+		replies     string
+		jobErr      error
+		wantSet     bool
+		wantRelease bool
+	}{
+		{"while_executing", "+OK\r\n:1\r\n", boom, true, true},
+		{"until_executed", "+OK\r\n:1\r\n", nil, true, true},
+		{"until_executed", "+OK\r\n", boom, true, false},
+		{"until_executed", "+OK\r\n:1\r\n", fmt.Errorf("%w: missing test_run_id", errBadArgs), true, true},
+		{"until_executed", "+OK\r\n:1\r\n", fmt.Errorf("%w: test_run 1 is locked by another worker", errDuplicateJob), true, true},
+		{"until_executing", ":1\r\n", nil, false, true},
+	}
+	for _, c := range cases {
+		cfg := uniqueConfig{classes: map[string]uniqueStrategy{"RubyWorker": uniqueStrategy(c.strategy)}, ttl: time.Minute}
+		rw, out := fakeRedis(c.replies)
+		err := uniqueMiddleware(cfg)(withRedis(context.Background(), rw), decodeJob(t, `{"class":"RubyWorker","args":[1],"jid":"mine"}`), "queue:go", func(ctx context.Context, job *sidekiqJob) error {
+			return c.jobErr
+		})
+		if err != c.jobErr {
+			t.Fatalf("%s: expected handler error %v, got %v", c.strategy, c.jobErr, err)
+		}
+		cmd := out.String()
+		if got := strings.Contains(cmd, "$3\r\nSET\r\n"); got != c.wantSet {
+			t.Fatalf("%s: SET sent=%t, want %t: %q", c.strategy, got, c.wantSet, cmd)
+		}
+		if got := strings.Contains(cmd, "EVALSHA"); got != c.wantRelease {
+			t.Fatalf("%s: release sent=%t, want %t: %q", c.strategy, got, c.wantRelease, cmd)
+		}
+	}
+}
+
+func TestEnqueueRejectsLockedDuplicate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	job, err := newJob("RubyWorker", []any{7}, enqueueOptions{Lock: uniqueUntilExecuted, LockTTL: time.Minute}, now)
+	if err != nil {
+		t.Fatalf("newJob error: %v", err)
+	}
+	var ttl float64
+	if err := json.Unmarshal(job.raw("lock_ttl"), &ttl); err != nil || ttl != 60 {
+		t.Fatalf("expected lock_ttl in payload, got %s", job.raw("lock_ttl"))
+	}
+	rw, out := fakeRedis("$-1\r\n$5\r\nother\r\n")
+	if _, err := enqueue(rw, job, time.Time{}, now); !errors.Is(err, errDuplicateJob) {
+		t.Fatalf("expected duplicate error, got %v", err)
+	}
+	if strings.Contains(out.String(), "LPUSH") {
+		t.Fatalf("duplicate must not be pushed: %q", out.String())
+	}
+}